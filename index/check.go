@@ -0,0 +1,263 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// at most this many problems are reported per file
+const MAX_PROBLEMS = 10
+
+type checker struct {
+	problems []string
+	reported map[string]int
+}
+
+func (c *checker) report(file string, format string, args ...interface{}) {
+	c.reported[file]++
+	if c.reported[file] == MAX_PROBLEMS+1 {
+		c.problems = append(c.problems, fmt.Sprintf("%s: more problems, not reported", file))
+	}
+	if c.reported[file] > MAX_PROBLEMS {
+		return
+	}
+	c.problems = append(c.problems, fmt.Sprintf("%s: %s", file, fmt.Sprintf(format, args...)))
+}
+
+// every entry of the header points inside data, if sorted the strings
+// have to be in increasing order for bsearch
+func (c *checker) checkStrings(name string, s *StoredStringArray, sorted bool) {
+	if len(s.header.m)%16 != 0 {
+		c.report(name+".header", "size %d is not a multiple of 16", len(s.header.m))
+	}
+	prev := ""
+	for i := 0; i < s.count(); i++ {
+		offlen := getUint64(s.header.m, uint32(i*16))
+		off := offlen >> 32
+		l := offlen & 0xFFFFFFFF
+		if off+l > uint64(len(s.data.m)) {
+			c.report(name+".header", "entry %d at %d+%d is outside of the data (%d bytes)", i, off, l, len(s.data.m))
+			continue
+		}
+		current, _ := s.read(uint32(i))
+		if sorted && i > 0 && strings.Compare(prev, current) >= 0 {
+			c.report(name+".data", "term %d %q is not after %q", i, current, prev)
+		}
+		prev = current
+	}
+}
+
+// every posting list of the dictionary has to decode, with strictly
+// increasing doc ids of documents in the segment, consistent with the
+// skip table. length is nil if the lists do not store document lengths
+func (c *checker) checkPostings(name string, dictionary *StoredStringArray, postings *MMaped, positional bool, docs int, length func(int32) uint32) {
+	for i := 0; i < dictionary.count(); i++ {
+		offlen := getUint64(dictionary.header.m, uint32(i*16))
+		if offlen>>32+offlen&0xFFFFFFFF > uint64(len(dictionary.data.m)) {
+			continue
+		}
+		term, _ := dictionary.read(uint32(i))
+		extra := dictionary.extra(uint32(i))
+		off := extra >> 32
+		l := extra & 0xFFFFFFFF
+		if off+l > uint64(len(postings.m)) {
+			c.report(name, "postings of %q at %d+%d are outside of the file (%d bytes)", term, off, l, len(postings.m))
+			continue
+		}
+		if problem := checkPostingsList(postingsAt(postings, extra), positional, docs, length); problem != "" {
+			c.report(name, "postings of %q: %s", term, problem)
+		}
+	}
+}
+
+func checkPostingsList(b []byte, positional bool, docs int, length func(int32) uint32) (problem string) {
+	defer func() {
+		if r := recover(); r != nil {
+			problem = fmt.Sprintf("cannot be decoded: %v", r)
+		}
+	}()
+	p := postingsIterator{}
+	p.reset(b, positional)
+	n := 0
+	last := int64(-1)
+	// the max tf and min length of the block and of the list, the score
+	// bounds of the top hits search rely on them
+	maxTf, minLength := uint32(0), uint32(0)
+	blockMaxTf, blockMinLength := uint32(0), uint32(0)
+	for p.next() {
+		doc := int64(p.doc())
+		if doc <= last {
+			return fmt.Sprintf("doc %d after doc %d", doc, last)
+		}
+		if doc >= int64(docs) {
+			return fmt.Sprintf("doc %d does not exist, the segment has %d documents", doc, docs)
+		}
+		if p.inblock == 1 {
+			blockMaxTf, blockMinLength = 0, math.MaxUint32
+		}
+		l := uint32(0)
+		if length != nil {
+			l = length(int32(doc))
+		}
+		if p.tf() > blockMaxTf {
+			blockMaxTf = p.tf()
+		}
+		if l < blockMinLength {
+			blockMinLength = l
+		}
+		if p.inblock == p.blockSize(p.block) {
+			if p.blockLast(p.block) != uint32(doc) {
+				return fmt.Sprintf("skip table says block %d ends with doc %d, it ends with %d", p.block, p.blockLast(p.block), doc)
+			}
+			if p.blockMaxTf(p.block) != blockMaxTf || p.blockMinLength(p.block) != blockMinLength {
+				return fmt.Sprintf("skip table says block %d has max tf %d and min length %d, it has %d and %d", p.block, p.blockMaxTf(p.block), p.blockMinLength(p.block), blockMaxTf, blockMinLength)
+			}
+			if p.block == 0 || blockMaxTf > maxTf {
+				maxTf = blockMaxTf
+			}
+			if p.block == 0 || blockMinLength < minLength {
+				minLength = blockMinLength
+			}
+		}
+		p.positions(nil)
+		last = doc
+		n++
+	}
+	if n != p.count {
+		return fmt.Sprintf("%d postings, expected %d", n, p.count)
+	}
+	if p.maxTf != maxTf || p.minLength != minLength {
+		return fmt.Sprintf("max tf %d and min length %d, expected %d and %d", p.maxTf, p.minLength, maxTf, minLength)
+	}
+	return ""
+}
+
+// opens the segment in root and checks everything the searches rely on,
+// returns the problems found
+func CheckSegment(root string) (problems []string) {
+	c := &checker{problems: []string{}, reported: map[string]int{}}
+	defer func() {
+		if r := recover(); r != nil {
+			problems = append(c.problems, fmt.Sprintf("%v", r))
+		}
+	}()
+
+	s, err := NewSegment(root)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer s.close()
+
+	if len(s.meta.m) != 16 {
+		c.report("meta", "size %d, expected 16", len(s.meta.m))
+		return c.problems
+	}
+	docs := s.forward.count()
+	c.checkStrings("forward", s.forward, false)
+	if len(s.docinfo.m) != docs*16 {
+		c.report("docinfo", "size %d, expected %d for %d documents", len(s.docinfo.m), docs*16, docs)
+	}
+	total := uint64(0)
+	for id := 0; id < docs; id++ {
+		total += uint64(s.docLength(int32(id)))
+	}
+	if expected := getUint64(s.meta.m, 8); total != expected {
+		c.report("forward.header", "documents have %d tokens, meta says %d", total, expected)
+	}
+	for id := docs; id < len(s.deleted)*64; id++ {
+		if s.isDeleted(int32(id)) {
+			c.report("deleted", "doc %d is deleted but does not exist", id)
+		}
+	}
+
+	c.checkStrings("inverted", s.inverted, true)
+	c.checkPostings("posting", s.inverted, s.postings, s.positions, docs, s.docLength)
+
+	c.checkStrings("trigram", s.trigrams, true)
+	for i := 0; i < s.trigrams.count(); i++ {
+		if t, _ := s.trigrams.read(uint32(i)); len(t) != 3 {
+			c.report("trigram.data", "term %d %q is not a trigram", i, t)
+		}
+	}
+	c.checkPostings("trigram.posting", s.trigrams, s.trigramPostings, false, docs, nil)
+	return c.problems
+}
+
+// checks the manifest and every segment of the index, cb is called with
+// the problems of each segment (empty if it is fine). if quarantine is
+// true broken segments are removed from the manifest and moved to the
+// quarantine directory of the index. returns the number of broken
+// segments
+func Check(name string, quarantine bool, cb func(root string, problems []string)) (int, error) {
+	dirs, err := segmentDirs(name)
+	if err != nil {
+		return 0, err
+	}
+	listed := map[string]bool{}
+	broken := 0
+	for _, root := range dirs {
+		listed[path.Base(root)] = true
+		var problems []string
+		if _, err := os.Stat(root); err != nil {
+			problems = []string{fmt.Sprintf("listed in the manifest but %s", err)}
+		} else {
+			problems = CheckSegment(root)
+		}
+		cb(root, problems)
+		if len(problems) == 0 {
+			continue
+		}
+		broken++
+		if quarantine {
+			if err := quarantineSegment(name, root); err != nil {
+				return broken, err
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(name)
+	if err != nil {
+		return broken, err
+	}
+	for _, f := range files {
+		if f.IsDir() && !listed[f.Name()] && f.Name() != "quarantine" {
+			log.Printf("%s: not in the manifest, ignored", path.Join(name, f.Name()))
+		}
+	}
+	return broken, nil
+}
+
+// removes the segment from the manifest first, so the index never lists
+// a segment that is not there
+func quarantineSegment(name string, root string) error {
+	err := updateManifest(name, func(m *manifest) bool {
+		segments := []string{}
+		for _, s := range m.Segments {
+			if s != path.Base(root) {
+				segments = append(segments, s)
+			}
+		}
+		m.Segments = segments
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil
+	}
+	dir := path.Join(name, "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(root, path.Join(dir, path.Base(root))); err != nil {
+		return err
+	}
+	log.Printf("%s: moved to %s", root, dir)
+	return nil
+}
@@ -0,0 +1,54 @@
+package index
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSegment(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewSegment(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+		"/src/net/tcp.go": "func ListenTCP(network string) (*TCPListener, error)",
+	})
+	if err := s.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if problems := CheckSegment(root); len(problems) != 0 {
+		t.Fatalf("expected no problems, actual %v", problems)
+	}
+
+	if s, err = NewSegment(root); err != nil {
+		t.Fatal(err)
+	}
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+	})
+	s.addInverted("missing", 5, 1, []uint32{0})
+	s.addInverted("unsorted", 0, 1, []uint32{0})
+	s.addInverted("unsorted", 0, 1, []uint32{1})
+	s.delete(70)
+	if err := s.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	problems := strings.Join(CheckSegment(root), "\n")
+	for _, expected := range []string{
+		`posting: postings of "missing": doc 5 does not exist, the segment has 1 documents`,
+		`posting: postings of "unsorted": doc 0 after doc 0`,
+		`deleted: doc 70 is deleted but does not exist`,
+	} {
+		if !strings.Contains(problems, expected) {
+			t.Errorf("expected %s in %s", expected, problems)
+		}
+	}
+}
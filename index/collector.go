@@ -0,0 +1,308 @@
+package index
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// highest score first
+	SORT_SCORE = iota
+	// by path
+	SORT_PATH
+	// most recently modified first
+	SORT_MTIME
+)
+
+var SORTS = map[string]int{
+	"score": SORT_SCORE,
+	"path":  SORT_PATH,
+	"mtime": SORT_MTIME,
+}
+
+func ParseSort(name string) (int, error) {
+	if sort, ok := SORTS[name]; ok {
+		return sort, nil
+	}
+	return 0, fmt.Errorf("unknown sort %#v, use score, path or mtime", name)
+}
+
+// a matching document. the path and mtime are read from the segment
+// the first time they are needed
+type Doc struct {
+	Segment  int
+	Id       int32
+	Score    float64
+	segment  *Segment
+	path     string
+	mtime    int64
+	hasMtime bool
+}
+
+func (d *Doc) Path() string {
+	if d.path == "" && d.segment != nil {
+		d.path, _ = d.segment.forward.read(uint32(d.Id))
+	}
+	return d.path
+}
+
+func (d *Doc) Mtime() int64 {
+	if !d.hasMtime && d.segment != nil {
+		d.mtime = d.segment.docInfo(d.Id).mtime
+		d.hasMtime = true
+	}
+	return d.mtime
+}
+
+func (d *Doc) hit() *Hit {
+	return &Hit{Path: d.Path(), Id: d.Id, Segment: d.Segment, Score: d.Score, Mtime: d.Mtime()}
+}
+
+// receives the matching documents of a search. every worker of
+// Index.Collect collects into its own collector made with New, which are
+// merged into the one passed to Collect at the end
+type Collector interface {
+	// doc is reused for the next document, copy it to keep it
+	Collect(doc *Doc)
+	New() Collector
+	Merge(other Collector)
+}
+
+// a collector that only wants the documents that score at least
+// MinScore, which can only increase. Index.Collect skips the others and
+// calls Skipped when it did
+type minScorer interface {
+	MinScore() float64
+	Skipped()
+}
+
+// only counts the matching documents
+type CountCollector struct {
+	Total int
+}
+
+func (c *CountCollector) Collect(doc *Doc) {
+	c.Total++
+}
+
+func (c *CountCollector) New() Collector {
+	return &CountCollector{}
+}
+
+func (c *CountCollector) Merge(other Collector) {
+	c.Total += other.(*CountCollector).Total
+}
+
+// keeps every matching document, in no particular order
+type AllCollector struct {
+	Hits []*Hit
+}
+
+func (c *AllCollector) Collect(doc *Doc) {
+	c.Hits = append(c.Hits, doc.hit())
+}
+
+func (c *AllCollector) New() Collector {
+	return &AllCollector{}
+}
+
+func (c *AllCollector) Merge(other Collector) {
+	c.Hits = append(c.Hits, other.(*AllCollector).Hits...)
+}
+
+// keeps the best offset+limit documents in a min-heap (the worst of them
+// on top, to be replaced by a better one) and returns the limit after
+// the first offset. documents are ordered by sort and then by path, so
+// the order does not depend on the segments. if after is set only the
+// documents that come after it are collected, see Next. when sorting by
+// score the documents that cannot make it into a full heap are skipped
+// unless ExactTotal is set, see Exact
+type TopCollector struct {
+	// all the matching documents, also those before after
+	Total int
+	// count every matching document, do not skip any
+	ExactTotal  bool
+	limit       int
+	offset      int
+	sort        int
+	after       *Doc
+	heap        docHeap
+	approximate bool
+}
+
+// the worst document is docs[0]
+type docHeap struct {
+	docs []Doc
+	c    *TopCollector
+}
+
+func (h *docHeap) Len() int           { return len(h.docs) }
+func (h *docHeap) Less(i, j int) bool { return h.c.before(&h.docs[j], &h.docs[i]) }
+func (h *docHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *docHeap) Push(x interface{}) { h.docs = append(h.docs, x.(Doc)) }
+func (h *docHeap) Pop() interface{} {
+	doc := h.docs[len(h.docs)-1]
+	h.docs = h.docs[:len(h.docs)-1]
+	return doc
+}
+
+// after is the cursor returned by Next for the previous page, or empty.
+// returns an error if limit or offset is negative
+func NewTopCollector(limit int, offset int, sort int, after string) (*TopCollector, error) {
+	if limit < 0 || offset < 0 {
+		return nil, fmt.Errorf("invalid limit %d or offset %d, they cannot be negative", limit, offset)
+	}
+	c := &TopCollector{limit: limit, offset: offset, sort: sort}
+	c.heap.c = c
+	if after != "" {
+		doc, err := parseCursor(after, sort)
+		if err != nil {
+			return nil, err
+		}
+		c.after = doc
+	}
+	return c, nil
+}
+
+// value:path, the value is the score or mtime and empty when sorting by
+// path
+func parseCursor(cursor string, sort int) (*Doc, error) {
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	value := cursor[:i]
+	doc := &Doc{path: cursor[i+1:], hasMtime: true}
+	var err error
+	switch sort {
+	case SORT_SCORE:
+		doc.Score, err = strconv.ParseFloat(value, 64)
+	case SORT_MTIME:
+		doc.mtime, err = strconv.ParseInt(value, 10, 64)
+	default:
+		if value != "" {
+			err = fmt.Errorf("expected no value")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor %q for the sort: %s", cursor, err)
+	}
+	return doc, nil
+}
+
+func (c *TopCollector) cursor(doc *Doc) string {
+	switch c.sort {
+	case SORT_SCORE:
+		return strconv.FormatFloat(doc.Score, 'g', -1, 64) + ":" + doc.Path()
+	case SORT_MTIME:
+		return strconv.FormatInt(doc.Mtime(), 10) + ":" + doc.Path()
+	}
+	return ":" + doc.Path()
+}
+
+// true if a comes before b
+func (c *TopCollector) before(a *Doc, b *Doc) bool {
+	switch c.sort {
+	case SORT_SCORE:
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+	case SORT_MTIME:
+		if a.Mtime() != b.Mtime() {
+			return a.Mtime() > b.Mtime()
+		}
+	}
+	return a.Path() < b.Path()
+}
+
+func (c *TopCollector) Collect(doc *Doc) {
+	c.Total++
+	if c.after != nil && !c.before(c.after, doc) {
+		return
+	}
+	c.add(doc)
+}
+
+func (c *TopCollector) add(doc *Doc) {
+	h := &c.heap
+	if len(h.docs) < c.offset+c.limit {
+		heap.Push(h, *doc)
+	} else if len(h.docs) > 0 && c.before(doc, &h.docs[0]) {
+		h.docs[0] = *doc
+		heap.Fix(h, 0)
+	}
+}
+
+// the score of the worst document once the heap is full, -Inf before,
+// when not sorting by score or with ExactTotal
+func (c *TopCollector) MinScore() float64 {
+	h := &c.heap
+	if c.sort != SORT_SCORE || c.ExactTotal || len(h.docs) == 0 || len(h.docs) < c.offset+c.limit {
+		return math.Inf(-1)
+	}
+	return h.docs[0].Score
+}
+
+func (c *TopCollector) Skipped() {
+	c.approximate = true
+}
+
+// false if documents were skipped below MinScore, Total is a lower bound
+// of the matching documents then
+func (c *TopCollector) Exact() bool {
+	return !c.approximate
+}
+
+func (c *TopCollector) New() Collector {
+	n := &TopCollector{ExactTotal: c.ExactTotal, limit: c.limit, offset: c.offset, sort: c.sort, after: c.after}
+	n.heap.c = n
+	return n
+}
+
+// the merged documents keep their path and mtime and no longer read the
+// segment, so c can be used after a Reload closed it
+func (c *TopCollector) Merge(other Collector) {
+	o := other.(*TopCollector)
+	c.Total += o.Total
+	c.approximate = c.approximate || o.approximate
+	for i := range o.heap.docs {
+		doc := o.heap.docs[i]
+		doc.Path()
+		doc.Mtime()
+		doc.segment = nil
+		c.add(&doc)
+	}
+}
+
+func (c *TopCollector) sorted() []Doc {
+	docs := append([]Doc{}, c.heap.docs...)
+	sort.Slice(docs, func(i, j int) bool { return c.before(&docs[i], &docs[j]) })
+	if len(docs) < c.offset {
+		return nil
+	}
+	return docs[c.offset:]
+}
+
+// the best documents after the first offset, in order
+func (c *TopCollector) Hits() []*Hit {
+	hits := []*Hit{}
+	docs := c.sorted()
+	for i := range docs {
+		hits = append(hits, docs[i].hit())
+	}
+	return hits
+}
+
+// the cursor of the last hit to pass as after for the next page, empty
+// if the page is not full because there are no more documents
+func (c *TopCollector) Next() string {
+	docs := c.sorted()
+	if len(docs) == 0 || len(docs) < c.limit {
+		return ""
+	}
+	return c.cursor(&docs[len(docs)-1])
+}
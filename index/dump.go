@@ -0,0 +1,93 @@
+package index
+
+import (
+	"path"
+	"strings"
+)
+
+// what was indexed, for debugging: the terms of the inverted index with
+// their doc freq, the postings of a term and the forward store. segment
+// names are the base names of the segment directories
+
+type TermInfo struct {
+	Segment string
+	Field   string
+	Term    string
+	DocFreq int
+}
+
+type PostingInfo struct {
+	Segment   string
+	Id        int32
+	Path      string
+	Count     uint32
+	Positions []uint32 `json:",omitempty"`
+	Deleted   bool
+}
+
+type DocumentInfo struct {
+	Segment string
+	Id      int32
+	Path    string
+	Length  uint32
+	Mtime   int64
+	Size    int64
+	Deleted bool
+}
+
+// field:text as in queries, for the terms of other fields than content
+func (t TermInfo) String() string {
+	if t.Field == FIELD_CONTENT {
+		return t.Term
+	}
+	return t.Field + ":" + t.Term
+}
+
+// the segments named segment, all if it is empty
+func (d *Index) dumpSegments(segment string) []*Segment {
+	segments := []*Segment{}
+	for _, s := range d.segments {
+		if segment == "" || path.Base(s.root) == segment {
+			segments = append(segments, s)
+		}
+	}
+	return segments
+}
+
+func (d *Index) DumpTerms(segment string, cb func(TermInfo)) {
+	p := postingsIterator{}
+	for _, s := range d.dumpSegments(segment) {
+		for i := uint32(0); i < uint32(s.inverted.count()); i++ {
+			term, _ := s.inverted.read(i)
+			field, text := splitFieldTerm(term)
+			p.reset(postingsAt(s.postings, s.inverted.extra(i)), s.positions)
+			cb(TermInfo{path.Base(s.root), field, text, p.count})
+		}
+	}
+}
+
+// term is a word or field:word like in queries, it is not tokenized
+func (d *Index) DumpPostings(segment string, term string, cb func(PostingInfo)) {
+	if i := strings.IndexByte(term, ':'); i > 0 && FIELDS[term[:i]] {
+		term = fieldTerm(term[:i], term[i+1:])
+	}
+	p := postingsIterator{}
+	for _, s := range d.dumpSegments(segment) {
+		p.reset(s.findPostingsList(term), s.positions)
+		for p.next() {
+			id := int32(p.doc())
+			doc, _ := s.forward.read(uint32(id))
+			cb(PostingInfo{path.Base(s.root), id, doc, p.tf(), p.positions(nil), s.isDeleted(id)})
+		}
+	}
+}
+
+func (d *Index) DumpForward(segment string, cb func(DocumentInfo)) {
+	for _, s := range d.dumpSegments(segment) {
+		for id := int32(0); id < int32(s.forward.count()); id++ {
+			doc, _ := s.forward.read(uint32(id))
+			info := s.docInfo(id)
+			cb(DocumentInfo{path.Base(s.root), id, doc, s.docLength(id), info.mtime, info.size, s.isDeleted(id)})
+		}
+	}
+}
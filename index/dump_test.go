@@ -0,0 +1,72 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	src := t.TempDir()
+	write := func(name string, data string) {
+		if err := ioutil.WriteFile(path.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1, SegmentsAtATime: 1})
+	write("tcp.go", "func ListenTCP(network string)")
+	write("udp.go", "func ListenUDP(network string)")
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	write("tcp.go", "func ListenTCP(network string, network string)")
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	index, err := NewIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	terms := map[string]int{}
+	index.DumpTerms("segment.0", func(t TermInfo) {
+		terms[t.String()] = t.DocFreq
+	})
+	for term, df := range map[string]int{"ListenTCP": 1, "ListenUDP": 1, "network": 2, "file:udp": 1, "ext:go": 2} {
+		if terms[term] != df {
+			t.Fatalf("%s: expected doc freq %d, actual %d in %v", term, df, terms[term], terms)
+		}
+	}
+
+	// the counts are weighted: a token of a func line counts 11, a token
+	// of the file name FILENAME_WEIGHT without positions
+	var tests = []struct {
+		term     string
+		expected []string
+	}{
+		{"network", []string{"segment.0 0 tcp.go 11 [2] true", "segment.0 1 udp.go 11 [2] false", "segment.1 0 tcp.go 22 [2 4] false"}},
+		{"file:udp", []string{"segment.0 1 udp.go 200 [] false"}},
+		{"ListenSCTP", []string{}},
+	}
+	for _, test := range tests {
+		postings := []string{}
+		index.DumpPostings("", test.term, func(p PostingInfo) {
+			postings = append(postings, fmt.Sprintf("%s %d %s %d %v %v", p.Segment, p.Id, path.Base(p.Path), p.Count, p.Positions, p.Deleted))
+		})
+		if strings.Join(postings, "\n") != strings.Join(test.expected, "\n") {
+			t.Fatalf("%s: expected %v, actual %v", test.term, test.expected, postings)
+		}
+	}
+
+	forward := []string{}
+	index.DumpForward("segment.1", func(d DocumentInfo) {
+		forward = append(forward, fmt.Sprintf("%s %d %s %d %d %v", d.Segment, d.Id, path.Base(d.Path), d.Length, d.Size, d.Deleted))
+	})
+	if expected := "[segment.1 0 tcp.go 6 46 false]"; fmt.Sprint(forward) != expected {
+		t.Fatalf("expected %s, actual %v", expected, forward)
+	}
+}
@@ -0,0 +1,61 @@
+package index
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// every term in the inverted index belongs to a field, the content
+// terms are stored as they are, terms of the other fields are prefixed
+// with the field name and a byte that Tokenize never emits
+const (
+	FIELD_CONTENT   = "content"
+	FIELD_PATH      = "path"
+	FIELD_BASENAME  = "file"
+	FIELD_EXTENSION = "ext"
+	FIELD_REPO      = "repo"
+
+	// not a field of the inverted index, the terms come from the
+	// trigram index of the segment
+	FIELD_TRIGRAM = "trigram"
+)
+
+const FIELD_SEPARATOR = "\x00"
+
+var FIELDS = map[string]bool{
+	FIELD_CONTENT:   true,
+	FIELD_PATH:      true,
+	FIELD_BASENAME:  true,
+	FIELD_EXTENSION: true,
+	FIELD_REPO:      true,
+}
+
+// fields searched by words without explicit field
+var DEFAULT_FIELDS = []string{FIELD_CONTENT, FIELD_BASENAME, FIELD_PATH, FIELD_EXTENSION}
+
+func fieldTerm(field string, text string) string {
+	if field == FIELD_CONTENT {
+		return text
+	}
+	return field + FIELD_SEPARATOR + text
+}
+
+func splitFieldTerm(term string) (string, string) {
+	if i := strings.Index(term, FIELD_SEPARATOR); i != -1 {
+		return term[:i], term[i+1:]
+	}
+	return FIELD_CONTENT, term
+}
+
+// the repository of a file is the first directory under the indexed
+// root, or the root itself for files directly in it
+func repository(root string, file string) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return ""
+	}
+	if parts := strings.Split(rel, string(filepath.Separator)); len(parts) > 1 {
+		return parts[0]
+	}
+	return filepath.Base(root)
+}
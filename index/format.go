@@ -0,0 +1,55 @@
+package index
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+// every segment file starts with FILE_MAGIC and FORMAT_VERSION and ends
+// with the crc32 of everything before it:
+//
+//	magic u32 | version u32 | content ... | crc32 u32
+//
+// so a truncated, corrupted or foreign file is detected when it is opened
+const (
+	FILE_MAGIC  = 0x5a524348 // "ZRCH"
+	HEADER_SIZE = 8
+	FOOTER_SIZE = 4
+)
+
+func fileHeader() []byte {
+	b := make([]byte, HEADER_SIZE)
+	putUint32Off(b, 0, FILE_MAGIC)
+	putUint32Off(b, 4, FORMAT_VERSION)
+	return b
+}
+
+func fileFooter(crc uint32) []byte {
+	b := make([]byte, FOOTER_SIZE)
+	putUint32Off(b, 0, crc)
+	return b
+}
+
+// the content of a file written with fileHeader and fileFooter
+func frame(content []byte) []byte {
+	b := append(fileHeader(), content...)
+	return append(b, fileFooter(crc32.ChecksumIEEE(b))...)
+}
+
+// verifies the header and the checksum of a file and returns its content
+func unframe(name string, b []byte) ([]byte, error) {
+	if len(b) < HEADER_SIZE+FOOTER_SIZE {
+		return nil, fmt.Errorf("%s: truncated file, %d bytes", name, len(b))
+	}
+	if magic := getUint32(b, 0); magic != FILE_MAGIC {
+		return nil, fmt.Errorf("%s: not a zearch segment file (magic %#x), it was created by an older zearch or is corrupted, reindex", name, magic)
+	}
+	if version := getUint32(b, 4); version != FORMAT_VERSION {
+		return nil, fmt.Errorf("%s: unsupported segment format version %d, expected %d, reindex", name, version, FORMAT_VERSION)
+	}
+	end := len(b) - FOOTER_SIZE
+	if expected, actual := getUint32(b, uint32(end)), crc32.ChecksumIEEE(b[:end]); expected != actual {
+		return nil, fmt.Errorf("%s: checksum mismatch (%#x, expected %#x), the file is truncated or corrupted", name, actual, expected)
+	}
+	return b[HEADER_SIZE:end], nil
+}
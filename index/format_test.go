@@ -0,0 +1,35 @@
+package index
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	content := []byte("some content")
+	b := frame(content)
+	if actual, err := unframe("test", b); err != nil || string(actual) != string(content) {
+		t.Fatalf("expected %s, actual %s %v", content, actual, err)
+	}
+
+	corrupted := append([]byte{}, b...)
+	corrupted[HEADER_SIZE+1] ^= 1
+	version := append([]byte{}, b...)
+	putUint32Off(version, 4, FORMAT_VERSION+1)
+
+	var tests = []struct {
+		b        []byte
+		expected string
+	}{
+		{b[:len(b)-1], "checksum mismatch"},
+		{b[:5], "truncated"},
+		{corrupted, "checksum mismatch"},
+		{version, "unsupported segment format version"},
+		{content, "not a zearch segment file"},
+	}
+	for _, test := range tests {
+		if _, err := unframe("test", test.b); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected %s, actual %v", test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// every edit multiplies the score of a term of a FuzzyQuery by this
+const FUZZY_DECAY = 0.5
+
+// the distance of word~ without a number: 0 for words shorter than 3
+// characters, 1 up to 5 and 2 for longer words
+func fuzzyDistance(text string) int {
+	switch {
+	case len(text) < 3:
+		return 0
+	case len(text) < 6:
+		return 1
+	}
+	return 2
+}
+
+// matches the documents of the terms that are at most distance edits
+// away from text, where an edit inserts, removes or replaces a character
+// or swaps two adjacent ones, e.g. AtomicLnog~ finds AtomicLong. the
+// terms are found in each segment by running a levenshtein automaton for
+// text over the sorted dictionary, which skips all the terms that start
+// with a prefix the automaton rejects. they are searched as a
+// BoolOrQuery, each scored FUZZY_DECAY^edits times a term
+type FuzzyQuery struct {
+	field    string
+	text     string
+	distance int
+	scoring  int
+	expandedQuery
+}
+
+func NewFuzzyQuery(field string, text string, distance int) *FuzzyQuery {
+	return &FuzzyQuery{
+		field:         field,
+		text:          text,
+		distance:      distance,
+		scoring:       DEFAULT_SCORING,
+		expandedQuery: expandedQuery{NewBoolOrQuery([]Query{})},
+	}
+}
+
+func (q *FuzzyQuery) String() string {
+	if q.field == FIELD_CONTENT {
+		return fmt.Sprintf("%s~%d", q.text, q.distance)
+	}
+	return fmt.Sprintf("%s:%s~%d", q.field, q.text, q.distance)
+}
+
+func (q *FuzzyQuery) match(text string) bool {
+	l := &levenshtein{q.text, q.distance}
+	row := l.start()
+	var before []int
+	for i := 0; i < len(text); i++ {
+		prev := byte(0)
+		if i > 0 {
+			prev = text[i-1]
+		}
+		row, before = l.step(row, before, prev, text[i]), row
+	}
+	return l.distance(row) <= q.distance
+}
+
+func (q *FuzzyQuery) Clone() Query {
+	c := NewFuzzyQuery(q.field, q.text, q.distance)
+	c.scoring = q.scoring
+	return c
+}
+
+func (q *FuzzyQuery) Prepare(s *Segment) {
+	terms := []*Term{}
+	for _, e := range s.fuzzyTerms(q.field, q.text, q.distance) {
+		t := NewFieldTerm(q.field, e.text)
+		t.scoring = q.scoring
+		t.boost = math.Pow(FUZZY_DECAY, float64(e.distance))
+		terms = append(terms, t)
+	}
+	q.prepare(s, terms)
+}
+
+// the terms of field within max edits of text. the automaton states of
+// the prefix a term shares with the previous one are reused, and once a
+// prefix is rejected the dictionary is searched for the first term that
+// does not start with it
+func (s *Segment) fuzzyTerms(field string, text string, max int) []expansion {
+	expansions := []expansion{}
+	l := &levenshtein{text, max}
+	prefix := []byte(fieldTerm(field, ""))
+	// rows[i] is the state after the first i bytes of last
+	rows := [][]int{l.start()}
+	var last []byte
+	for id := s.inverted.search(prefix); id < s.inverted.count(); {
+		term := s.inverted.bytes(id)
+		if !bytes.HasPrefix(term, prefix) {
+			break
+		}
+		if next := s.skipFieldTerms(field, term); next != -1 {
+			id = next
+			continue
+		}
+		word := term[len(prefix):]
+		shared := 0
+		for shared < len(rows)-1 && shared < len(word) && word[shared] == last[shared] {
+			shared++
+		}
+		rows = rows[:shared+1]
+		last = word
+
+		rejected := -1
+		for i := shared; i < len(word); i++ {
+			var before []int
+			prev := byte(0)
+			if i > 0 {
+				before, prev = rows[i-1], word[i-1]
+			}
+			row := l.step(rows[i], before, prev, word[i])
+			rows = append(rows, row)
+			if !l.canMatch(row) {
+				rejected = i + 1
+				break
+			}
+		}
+		if rejected != -1 {
+			next := prefixEnd(term[:len(prefix)+rejected])
+			if next == nil {
+				break
+			}
+			id = s.inverted.search(next)
+			continue
+		}
+
+		if d := l.distance(rows[len(word)]); d <= max {
+			expansions = append(expansions, s.expansion(string(word), s.inverted.extra(uint32(id)), d))
+		}
+		id++
+	}
+	return limitExpansions(expansions)
+}
+
+// the first string after all the strings that start with prefix, nil if
+// there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// a levenshtein automaton that accepts the strings within max edits of
+// text. its state after reading a string is the row of the edit
+// distances from each prefix of text to that string, capped at max+1
+type levenshtein struct {
+	text string
+	max  int
+}
+
+func (l *levenshtein) start() []int {
+	row := make([]int, len(l.text)+1)
+	for i := range row {
+		row[i] = l.cap(i)
+	}
+	return row
+}
+
+// the state after reading c. before is the state before the previous
+// character prev (nil at the start of the string), to swap them
+func (l *levenshtein) step(row []int, before []int, prev byte, c byte) []int {
+	next := make([]int, len(row))
+	next[0] = l.cap(row[0] + 1)
+	for i := 1; i < len(row); i++ {
+		d := row[i-1]
+		if l.text[i-1] != c {
+			d++
+		}
+		if row[i]+1 < d {
+			d = row[i] + 1
+		}
+		if next[i-1]+1 < d {
+			d = next[i-1] + 1
+		}
+		if before != nil && i > 1 && l.text[i-1] == prev && l.text[i-2] == c && before[i-2]+1 < d {
+			d = before[i-2] + 1
+		}
+		next[i] = l.cap(d)
+	}
+	return next
+}
+
+// false if no string that starts with the one read so far is accepted
+func (l *levenshtein) canMatch(row []int) bool {
+	for _, d := range row {
+		if d <= l.max {
+			return true
+		}
+	}
+	return false
+}
+
+// the edit distance of the string read so far, max+1 if it is too far
+func (l *levenshtein) distance(row []int) int {
+	return row[len(row)-1]
+}
+
+func (l *levenshtein) cap(d int) int {
+	if d > l.max {
+		return l.max + 1
+	}
+	return d
+}
@@ -0,0 +1,125 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// optimal string alignment distance, levenshtein with adjacent swaps
+func editDistance(a string, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func TestFuzzyTerms(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	word := func() string {
+		b := make([]byte, 3+r.Intn(6))
+		for i := range b {
+			b[i] = "abcd"[r.Intn(4)]
+		}
+		return string(b)
+	}
+	s := NewMemorySegment()
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	for i := 0; i < 200; i++ {
+		words := []string{}
+		for j := 0; j < 5; j++ {
+			words = append(words, word())
+		}
+		terms.add(indexable{fmt.Sprintf("/src/%s/%d.go", word(), i), "/src", docInfo{}, s}, []byte(strings.Join(words, " ")))
+	}
+	snapshot := s.Snapshot()
+
+	for i := 0; i < 50; i++ {
+		text := word()
+		for _, field := range []string{FIELD_CONTENT, FIELD_PATH} {
+			for max := 0; max <= 2; max++ {
+				expected := []string{}
+				for id := 0; id < snapshot.inverted.count(); id++ {
+					term, _ := snapshot.inverted.read(uint32(id))
+					if f, other := splitFieldTerm(term); f == field && editDistance(text, other) <= max {
+						expected = append(expected, fmt.Sprintf("%s %d", other, editDistance(text, other)))
+					}
+				}
+				actual := []string{}
+				for _, e := range snapshot.fuzzyTerms(field, text, max) {
+					actual = append(actual, fmt.Sprintf("%s %d", e.text, e.distance))
+					if q := NewFuzzyQuery(field, text, max); !q.match(e.text) {
+						t.Fatalf("%s~%d does not match %s", text, max, e.text)
+					}
+				}
+				if fmt.Sprint(actual) != fmt.Sprint(expected) {
+					t.Fatalf("%s:%s~%d: expected %v, actual %v", field, text, max, expected, actual)
+				}
+			}
+		}
+	}
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	s := NewMemorySegment()
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func AtomicLong(network string) (*UDPConn, error)",
+		"/src/net/tcp.go": "func AtomicLnog(network string) (*TCPListener, error)",
+		"/src/os/file.go": "func AtomicLoan(name string) (*File, error)",
+	})
+	snapshot := s.Snapshot()
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"AtomicLong~", []string{"/src/net/tcp.go", "/src/net/udp.go", "/src/os/file.go"}},
+		{"AtomicLong~1", []string{"/src/net/tcp.go", "/src/net/udp.go"}},
+		{"AtomicLong~0", []string{"/src/net/udp.go"}},
+		{"AtomicLnog~1 -path:os", []string{"/src/net/tcp.go", "/src/net/udp.go"}},
+		{"content:ne~1", []string{}},
+		{"path:ne~1", []string{"/src/net/tcp.go", "/src/net/udp.go"}},
+	}
+	for _, test := range tests {
+		actual := search(t, snapshot, test.query)
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, actual)
+		}
+	}
+
+	// every edit halves the score
+	q := NewFuzzyQuery(FIELD_CONTENT, "AtomicLong", 2)
+	q.Prepare(snapshot)
+	scores := map[int32]float64{}
+	for q.Next() != NO_MORE {
+		scores[q.GetDocId()] = q.Score()
+	}
+	if len(scores) != 3 || scores[1] != 2*scores[0] || scores[1] != 4*scores[2] {
+		t.Fatalf("expected the typos to score less, actual %v", scores)
+	}
+}
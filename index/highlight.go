@@ -0,0 +1,171 @@
+package index
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+const MAX_LINES_PER_HIT = 10
+
+// the most lines of context the server shows around a matching line
+const MAX_CONTEXT = 100
+
+// Start and End are character (not byte) offsets in the line
+type Match struct {
+	Start int
+	End   int
+}
+
+type Line struct {
+	Number  int
+	Text    string
+	Matches []Match
+	Before  []string `json:",omitempty"`
+	After   []string `json:",omitempty"`
+}
+
+// finds the lines of a file that match the content terms, phrases,
+// wildcards and regexps of a query, excluded (-term) parts of the query
+// are ignored
+type Highlighter struct {
+	terms map[string]bool
+	// wildcard and fuzzy queries
+	expansions []interface{ match(string) bool }
+	regexps    []*regexp.Regexp
+	tokenize   func(input string, cb func(text string, weird int))
+}
+
+func NewHighlighter(query Query) *Highlighter {
+	return NewHighlighterWithTokenizer(query, Tokenize)
+}
+
+// like NewHighlighter, for a query parsed with ParseWithTokenizer. each
+// token of a line (as Tokenize splits it) is split with tokenize and
+// highlighted if any of its parts matches
+func NewHighlighterWithTokenizer(query Query, tokenize func(input string, cb func(text string, weird int))) *Highlighter {
+	h := &Highlighter{terms: map[string]bool{}, tokenize: tokenize}
+	h.collect(query)
+	return h
+}
+
+func (h *Highlighter) collect(query Query) {
+	switch q := query.(type) {
+	case *Term:
+		if q.field == FIELD_CONTENT {
+			h.terms[q.text] = true
+		}
+	case *PhraseQuery:
+		for _, t := range q.terms {
+			h.collect(t)
+		}
+	case *WildcardQuery:
+		if q.field == FIELD_CONTENT {
+			h.expansions = append(h.expansions, q)
+		}
+	case *FuzzyQuery:
+		if q.field == FIELD_CONTENT {
+			h.expansions = append(h.expansions, q)
+		}
+	case *RegexpQuery:
+		h.regexps = append(h.regexps, q.re)
+	case *BoolAndQuery:
+		for _, sub := range q.queries {
+			h.collect(sub)
+		}
+	case *BoolOrQuery:
+		for _, sub := range q.queries {
+			h.collect(sub)
+		}
+	case *BoolNotQuery:
+		h.collect(q.must)
+	}
+}
+
+func (h *Highlighter) Empty() bool {
+	return len(h.terms) == 0 && len(h.expansions) == 0 && len(h.regexps) == 0
+}
+
+func (h *Highlighter) matchesTerm(text string) bool {
+	if h.terms[text] {
+		return true
+	}
+	for _, e := range h.expansions {
+		if e.match(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Highlighter) matches(line string) []Match {
+	matches := []Match{}
+	tokenizeWithOffsets(line, func(text string, weird int, offset int) {
+		matched := false
+		h.tokenize(text, func(part string, weird int) {
+			matched = matched || h.matchesTerm(part)
+		})
+		if matched {
+			matches = append(matches, Match{offset, offset + len(text)})
+		}
+	})
+	for _, re := range h.regexps {
+		for _, m := range re.FindAllStringIndex(line, -1) {
+			if m[1] > m[0] {
+				matches = append(matches, Match{m[0], m[1]})
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return matches
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+	merged := []Match{matches[0]}
+	for _, m := range matches[1:] {
+		last := &merged[len(merged)-1]
+		if m.Start <= last.End {
+			if m.End > last.End {
+				last.End = m.End
+			}
+		} else {
+			merged = append(merged, m)
+		}
+	}
+	for i := range merged {
+		merged[i].Start = utf8.RuneCountInString(line[:merged[i].Start])
+		merged[i].End = utf8.RuneCountInString(line[:merged[i].End])
+	}
+	return merged
+}
+
+// up to max matching lines of data, each with up to context lines
+// before and after it
+func (h *Highlighter) Lines(data []byte, context int, max int) []Line {
+	lines := []Line{}
+	text := bytes.Split(data, []byte("\n"))
+	for i := 0; i < len(text) && len(lines) < max; i++ {
+		line := string(text[i])
+		matches := h.matches(line)
+		if len(matches) == 0 {
+			continue
+		}
+		hit := Line{Number: i + 1, Text: line, Matches: matches}
+		start, end := i-context, len(text)-1
+		if start < 0 {
+			start = 0
+		}
+		if context < end-i {
+			end = i + context
+		}
+		for j := start; j < i; j++ {
+			hit.Before = append(hit.Before, string(text[j]))
+		}
+		for j := i + 1; j <= end; j++ {
+			hit.After = append(hit.After, string(text[j]))
+		}
+		lines = append(lines, hit)
+	}
+	return lines
+}
@@ -0,0 +1,49 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHighlighter(t *testing.T) {
+	q, err := Parse(`ListenUDP /Conn\(/ -test`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("package net\n// ListenUDP and test\nfunc ListenUDP() {\n\treturn newUDPConn(fd)\n}\n// ünïcode ListenUDP")
+	lines := NewHighlighter(q).Lines(data, 1, 3)
+
+	expected := []string{
+		`2 [{3 12}] [package net] [func ListenUDP() {]`,
+		`3 [{5 14}] [// ListenUDP and test] [	return newUDPConn(fd)]`,
+		`4 [{14 19}] [func ListenUDP() {] [}]`,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, actual %#v", len(expected), lines)
+	}
+	for i, line := range lines {
+		if actual := fmt.Sprintf("%d %v %v %v", line.Number, line.Matches, line.Before, line.After); actual != expected[i] {
+			t.Errorf("expected %s, actual %s", expected[i], actual)
+		}
+	}
+
+	lines = NewHighlighter(q).Lines(data, 0, 10)
+	if last := lines[len(lines)-1]; last.Number != 6 || fmt.Sprintf("%v", last.Matches) != "[{11 20}]" {
+		t.Errorf("expected character offsets, actual %#v", last)
+	}
+
+	// a huge context is the whole file, without a loop over it
+	lines = NewHighlighter(q).Lines(data, int(^uint(0)>>1), 1)
+	if len(lines) != 1 || len(lines[0].Before) != 1 || len(lines[0].After) != 4 {
+		t.Errorf("expected the whole file as context, actual %#v", lines)
+	}
+
+	q, err = Parse("Listen* -test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = NewHighlighter(q).Lines([]byte("ListenUDP Listener listen"), 0, 10)
+	if len(lines) != 1 || fmt.Sprintf("%v", lines[0].Matches) != "[{0 9} {10 18}]" {
+		t.Errorf("expected the wildcard matches, actual %#v", lines)
+	}
+}
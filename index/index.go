@@ -1,20 +1,26 @@
+// Package index writes and searches zearch indexes. NewIndexer and
+// NewSearcher are the entry points for programs embedding zearch, an
+// index is a directory of segments listed in its manifest.
 package index
 
 import (
-	"fmt"
+	"context"
 	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"path"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
 	FILENAME_WEIGHT = 200
 	FILEPATH_WEIGHT = 1
+	REPO_WEIGHT     = 1
 )
 
 var ONLY = map[string]bool{
@@ -28,42 +34,236 @@ var ONLY = map[string]bool{
 	".scala": true,
 }
 
+// store token positions in new segments, needed for exact phrase queries
+var STORE_POSITIONS = true
+
+// store a trigram index in new segments, used to find candidates for
+// regexp queries instead of matching every file
+var STORE_TRIGRAMS = true
+
 type Index struct {
-	segments []*Segment
+	segments   []*Segment
+	name       string
+	generation int
 }
 
-func NewIndex(name string) *Index {
-	s := path.Join(name,"segment.*")
-	log.Printf("loading index: %s", s)
-	matches, err := filepath.Glob(s)
+func openSegments(name string) ([]*Segment, error) {
+	log.Printf("loading index: %s", name)
+	dirs, err := segmentDirs(name)
 	if err != nil {
-		panic(err)
-	}
-	i := &Index{
-		segments: []*Segment{},
+		return nil, err
 	}
-	if matches != nil {
-		for _, match := range matches {
-			log.Printf("loading segment: %s", match)
-			i.segments = append(i.segments, NewSegment(match))
+	segments := []*Segment{}
+	for _, dir := range dirs {
+		log.Printf("loading segment: %s", dir)
+		s, err := NewSegment(dir)
+		if err != nil {
+			for _, s := range segments {
+				s.close()
+			}
+			return nil, err
 		}
+		segments = append(segments, s)
 	}
+	return segments, nil
+}
 
-	return i
+func NewIndex(name string) (*Index, error) {
+	segments, err := openSegments(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{
+		segments: segments,
+		name:     name,
+	}, nil
 }
 
-func (d *Index) ExecuteQuery(query Query, cb func(int32, int, int64)) {
+// opens the segments again from disk, to pick up segments added or
+// merged by another process, and closes the old ones. in-memory
+// segments are kept. if the index cannot be opened the old segments
+// are kept
+func (d *Index) Reload() error {
+	segments, err := openSegments(d.name)
+	if err != nil {
+		return err
+	}
+	for _, s := range d.segments {
+		if s.inMemory() {
+			segments = append(segments, s)
+		}
+	}
+	d.Close()
+	d.segments = segments
+	d.generation++
+	return nil
+}
+
+// ctx is checked every this many documents, and between segments
+const CHECK_CONTEXT_EVERY = 1024
+
+// how many segments are searched at the same time by default
+var SEARCH_PARALLELISM = runtime.GOMAXPROCS(0)
+
+// calls cb with the id, segment and score of every live document that
+// matches query, one segment after the other. stops when ctx is done and
+// returns ctx.Err(), cb has been called for some of the matching
+// documents then
+func (d *Index) ExecuteQuery(ctx context.Context, query Query, cb func(int32, int, float64)) error {
+	setContext(query, ctx)
 	for i := 0; i < len(d.segments); i++ {
-		query.Prepare(d.segments[i])
-		for query.Next() != NO_MORE {
-			id := query.GetDocId()
-			cb(id, i, query.Score())
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := d.executeSegment(ctx, query, i, cb, nil, nil); err != nil {
+			return err
+		}
+	}
+	// a regexp query stops early when ctx is done
+	return ctx.Err()
+}
+
+// passes the live documents that match query to c. up to parallelism
+// (SEARCH_PARALLELISM if 0) segments are searched at the same time, each
+// worker with its own clone of query and its own collector made with
+// c.New(), which are merged into c at the end. on ctx.Err() c has the
+// documents found so far. if the collectors have a MinScore method (see
+// TopCollector.MinScore) the highest min score of all the workers is
+// used to skip the documents that cannot score as much
+func (d *Index) Collect(ctx context.Context, query Query, c Collector, parallelism int) error {
+	setContext(query, ctx)
+	if parallelism <= 0 {
+		parallelism = SEARCH_PARALLELISM
+	}
+	if parallelism > len(d.segments) {
+		parallelism = len(d.segments)
+	}
+
+	todo := make(chan int, len(d.segments))
+	for i := range d.segments {
+		todo <- i
+	}
+	close(todo)
+
+	// the bits of a float64, to share it with atomic
+	shared := math.Float64bits(math.Inf(-1))
+	workers := make([]Collector, parallelism)
+	var wg sync.WaitGroup
+	for w := range workers {
+		collector := c.New()
+		workers[w] = collector
+		wg.Add(1)
+		go func(q Query) {
+			defer wg.Done()
+			var minScore func() float64
+			var skipped func()
+			if scorer, ok := collector.(minScorer); ok {
+				skipped = scorer.Skipped
+				minScore = func() float64 {
+					local := scorer.MinScore()
+					for {
+						old := atomic.LoadUint64(&shared)
+						if local <= math.Float64frombits(old) {
+							return math.Float64frombits(old)
+						}
+						if atomic.CompareAndSwapUint64(&shared, old, math.Float64bits(local)) {
+							return local
+						}
+					}
+				}
+			}
+			doc := &Doc{}
+			collect := func(id int32, segment int, score float64) {
+				*doc = Doc{Segment: segment, Id: id, Score: score, segment: d.segments[segment]}
+				collector.Collect(doc)
+			}
+			for i := range todo {
+				if ctx.Err() != nil {
+					return
+				}
+				if d.executeSegment(ctx, q, i, collect, minScore, skipped) != nil {
+					return
+				}
+			}
+		}(query.Clone())
+	}
+	wg.Wait()
+
+	for _, collector := range workers {
+		c.Merge(collector)
+	}
+	return ctx.Err()
+}
+
+// runs query on segment i, see ExecuteQuery. once minScore (if not nil)
+// is above -Inf the documents that score less are skipped: the whole
+// segment if the max score of the query is lower, the blocks of postings
+// whose block max score is lower, and the documents that only match
+// queries of a BoolOrQuery that cannot add up to it. skipped is called
+// when matching documents may have been skipped
+func (d *Index) executeSegment(ctx context.Context, query Query, i int, cb func(int32, int, float64), minScore func() float64, skipped func()) error {
+	s := d.segments[i]
+	query.Prepare(s)
+	n := 0
+	target := int32(0)
+	bound, upto := float64(0), int32(-1)
+	for {
+		if n++; n%CHECK_CONTEXT_EVERY == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		min := math.Inf(-1)
+		if minScore != nil {
+			min = minScore()
 		}
+		var id int32
+		if math.IsInf(min, -1) {
+			id = query.Next()
+		} else {
+			if !competitive(query.maxScore(), min) {
+				if bound, upto := query.blockMaxScore(target); !exhausted(bound, upto) {
+					skipped()
+				}
+				return nil
+			}
+			if query.setMinScore(min) {
+				skipped()
+			}
+			if target > upto {
+				bound, upto = query.blockMaxScore(target)
+			}
+			if !competitive(bound, min) {
+				if !exhausted(bound, upto) {
+					skipped()
+				}
+				if upto >= NO_MORE-1 {
+					return nil
+				}
+				target = upto + 1
+				continue
+			}
+			id = query.advance(target)
+		}
+		if id == NO_MORE {
+			return nil
+		}
+		target = id + 1
+		if s.isDeleted(id) {
+			continue
+		}
+		cb(id, i, query.Score())
 	}
 }
 
+// true if the block max score bound up to upto says that the query has
+// no documents left
+func exhausted(bound float64, upto int32) bool {
+	return bound == 0 && upto == NO_MORE
+}
+
 func (d *Index) FetchForward(id int, segment int) (string, bool) {
-	if segment < 0 || segment > len(d.segments) {
+	if segment < 0 || segment >= len(d.segments) {
 		return "", false
 	}
 	if s, ok := d.segments[segment].forward.read(uint32(id)); ok {
@@ -76,7 +276,7 @@ func (d *Index) Stats() (int, int) {
 	total := 0
 	approxterms := 0
 	for _, s := range d.segments {
-		total += s.forward.count()
+		total += s.forward.count() - s.deletedCount()
 		approxterms += s.inverted.count()
 	}
 
@@ -91,31 +291,104 @@ func (d *Index) Close() {
 
 type indexable struct {
 	path    string
+	root    string
+	info    docInfo
 	segment *Segment
 }
 
-func tokenizeAndAdd(input chan indexable, done chan int) {
-	uniq := map[string]int{}
-	inc := func(text string, n int) {
-		if len(text) > 0 {
-			if current, ok := uniq[text]; ok {
-				n += current
-			}
-			uniq[text] = n
+// the term counts and positions of the document being added, reused
+// between documents
+type documentTerms struct {
+	uniq      map[string]int
+	positions map[string][]uint32
+	options   *IndexerOptions
+}
+
+func newDocumentTerms(options *IndexerOptions) *documentTerms {
+	return &documentTerms{
+		uniq:      map[string]int{},
+		positions: map[string][]uint32{},
+		options:   options,
+	}
+}
+
+func (d *documentTerms) inc(field string, text string, n int) {
+	if len(text) > 0 {
+		text = fieldTerm(field, text)
+		if current, ok := d.uniq[text]; ok {
+			n += current
 		}
+		d.uniq[text] = n
 	}
-	edge := func(text string, max int) {
-		for i := 2; i < len(text); i++ {
-			// create left edge ngrams with increasing weight
-			// at
-			// ato
-			// atom
-			// atomic
-			// ..
-			inc(text[:i+1], max/(len(text)-i))
+}
+
+func (d *documentTerms) edge(text string, max int) {
+	for i := 2; i < len(text); i++ {
+		// create left edge ngrams with increasing weight
+		// at
+		// ato
+		// atom
+		// atomic
+		// ..
+		d.inc(FIELD_BASENAME, text[:i+1], max/(len(text)-i))
+	}
+}
+
+// tokenizes data and adds it to todo.segment
+func (d *documentTerms) add(todo indexable, data []byte) {
+	o := d.options
+	pos := uint32(0)
+	o.Tokenizer(string(data), func(text string, weird int) {
+		if len(text) > 2 {
+			d.inc(FIELD_CONTENT, text, 1+(weird*10))
+			d.positions[text] = append(d.positions[text], pos)
 		}
+		pos++
+	})
+
+	dir, name := filepath.Split(todo.path)
+	o.Tokenizer(dir, func(text string, weird int) {
+		d.inc(FIELD_PATH, text, o.PathWeight)
+	})
+	o.Tokenizer(repository(todo.root, todo.path), func(text string, weird int) {
+		d.inc(FIELD_REPO, text, o.RepoWeight)
+	})
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext)
+	d.edge(name, o.FilenameWeight)
+	if len(ext) > 0 {
+		d.inc(FIELD_EXTENSION, ext[1:], o.FilenameWeight)
+	}
+
+	tri := []string{}
+	if todo.segment.hasTrigrams {
+		trigrams(data, func(t string) {
+			tri = append(tri, t)
+		})
+	}
+
+	todo.segment.Lock()
+	id := todo.segment.addForward(todo.path, pos, todo.info)
+
+	for text, count := range d.uniq {
+		todo.segment.addInverted(text, id, uint32(count), d.positions[text])
+	}
+	for _, t := range tri {
+		todo.segment.addTrigram(t, id)
+	}
+
+	todo.segment.Unlock()
+
+	for k := range d.uniq {
+		delete(d.uniq, k)
+	}
+	for k := range d.positions {
+		delete(d.positions, k)
 	}
+}
 
+func (x *Indexer) tokenizeAndAdd(input chan indexable, done chan int) {
+	terms := newDocumentTerms(&x.options)
 	for {
 		select {
 		case todo := <-input:
@@ -124,53 +397,285 @@ func tokenizeAndAdd(input chan indexable, done chan int) {
 				log.Print(err)
 				continue
 			}
-			Tokenize(string(data), func(text string, weird int) {
-				if len(text) > 2 {
-					inc(text, 1+(weird*10))
-				}
-			})
+			terms.add(todo, data)
+		case <-done:
+			return
+		}
+	}
+}
 
-			dir, name := filepath.Split(todo.path)
-			for _, di := range strings.Split(dir, "/") {
-				inc(di, FILEPATH_WEIGHT)
-			}
-			ext := filepath.Ext(name)
-			name = strings.TrimSuffix(name, ext)
-			edge(name, FILENAME_WEIGHT)
-			inc(ext[1:], FILENAME_WEIGHT)
+// what an Indexer indexes and how, start from DefaultIndexerOptions
+type IndexerOptions struct {
+	// only files with one of these extensions are indexed, e.g. ".go"
+	Extensions []string
+	// number of goroutines reading and tokenizing files
+	Workers int
+	// documents per segment, and number of segments filled at the same
+	// time (by different workers)
+	SegmentDocs     int
+	SegmentsAtATime int
+	// do not store positions (for phrase queries) or trigrams (for
+	// regexp queries) in the new segments
+	NoPositions bool
+	NoTrigrams  bool
+	// how much the tokens of the file name, the directories and the
+	// repository count, a token of the content counts 1
+	FilenameWeight int
+	PathWeight     int
+	RepoWeight     int
+	// splits the content and the path of a file into tokens, weird is 1
+	// for the tokens that should count more (like the name of a
+	// function). the Searchers of Indexer.NewSearcher split the words
+	// of queries with it too
+	Tokenizer func(input string, cb func(text string, weird int))
+}
 
-			todo.segment.Lock()
-			id := todo.segment.addForward(todo.path)
+// the options zearch indexes with, from ONLY, STORE_POSITIONS and
+// STORE_TRIGRAMS
+func DefaultIndexerOptions() IndexerOptions {
+	extensions := []string{}
+	for ext := range ONLY {
+		extensions = append(extensions, ext)
+	}
+	return IndexerOptions{
+		Extensions:      extensions,
+		Workers:         runtime.GOMAXPROCS(0),
+		SegmentDocs:     500,
+		SegmentsAtATime: 2,
+		NoPositions:     !STORE_POSITIONS,
+		NoTrigrams:      !STORE_TRIGRAMS,
+		FilenameWeight:  FILENAME_WEIGHT,
+		PathWeight:      FILEPATH_WEIGHT,
+		RepoWeight:      REPO_WEIGHT,
+		Tokenizer:       Tokenize,
+	}
+}
 
-			for text, count := range uniq {
-				if count > 1024 {
-					count = 1024
-				}
-				todo.segment.addInverted(text, id<<10|int32(count))
+// writes and updates the index in the directory name
+type Indexer struct {
+	name       string
+	options    IndexerOptions
+	extensions map[string]bool
+}
+
+// the zero values of the numbers and a nil Extensions or Tokenizer in
+// options are replaced by their defaults
+func NewIndexer(name string, options IndexerOptions) *Indexer {
+	def := DefaultIndexerOptions()
+	if options.Extensions == nil {
+		options.Extensions = def.Extensions
+	}
+	if options.Workers <= 0 {
+		options.Workers = def.Workers
+	}
+	if options.SegmentDocs <= 0 {
+		options.SegmentDocs = def.SegmentDocs
+	}
+	if options.SegmentsAtATime <= 0 {
+		options.SegmentsAtATime = def.SegmentsAtATime
+	}
+	if options.FilenameWeight == 0 {
+		options.FilenameWeight = def.FilenameWeight
+	}
+	if options.PathWeight == 0 {
+		options.PathWeight = def.PathWeight
+	}
+	if options.RepoWeight == 0 {
+		options.RepoWeight = def.RepoWeight
+	}
+	if options.Tokenizer == nil {
+		options.Tokenizer = def.Tokenizer
+	}
+	extensions := map[string]bool{}
+	for _, ext := range options.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions[ext] = true
+	}
+	return &Indexer{name: name, options: options, extensions: extensions}
+}
+
+// indexes args into new segments that replace the existing ones, with
+// the default options
+func DoIndex(name string, args []string) error {
+	return NewIndexer(name, DefaultIndexerOptions()).Index(args)
+}
+
+// updates the index in name with the default options, see Update
+func DoIndexIncremental(name string, args []string) error {
+	return NewIndexer(name, DefaultIndexerOptions()).Update(args)
+}
+
+// indexes the files under args into new segments that replace the
+// existing ones. files that cannot be read are logged and skipped
+func (x *Indexer) Index(args []string) error {
+	unlock, err := lockWriter(x.name, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := segmentDirs(x.name)
+	if err != nil {
+		return err
+	}
+	written, err := x.index(args, func(path string, f os.FileInfo) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	_, err = commit(x.name, written, old)
+	return err
+}
+
+// updates an existing index: new and modified (by mtime and size) files
+// are indexed into new segments, the old versions of the modified files
+// and the files that no longer exist are marked as deleted
+func (x *Indexer) Update(args []string) error {
+	unlock, err := lockWriter(x.name, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := NewIndex(x.name)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	known, stale := knownDocuments(index.segments)
+
+	seen := map[string]bool{}
+	changed := map[*Segment]bool{}
+	for _, old := range stale {
+		old.segment.delete(old.id)
+		changed[old.segment] = true
+	}
+	added, modified, removed := 0, 0, 0
+	written, err := x.index(args, func(path string, f os.FileInfo) bool {
+		seen[path] = true
+		old, ok := known[path]
+		if !ok {
+			added++
+			return true
+		}
+		if old.info == newDocInfo(f) {
+			return false
+		}
+		old.segment.delete(old.id)
+		changed[old.segment] = true
+		modified++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for path, old := range known {
+		if seen[path] {
+			continue
+		}
+		for _, arg := range args {
+			if isUnder(path, arg) {
+				old.segment.delete(old.id)
+				changed[old.segment] = true
+				removed++
+				break
 			}
+		}
+	}
+	// the tombstones are saved after the new versions are committed: a
+	// crash in between leaves both versions, and the next update deletes
+	// the stale one
+	if _, err := commit(x.name, written, nil); err != nil {
+		return err
+	}
+	for s := range changed {
+		if err := s.saveDeleted(); err != nil {
+			return err
+		}
+	}
+	log.Printf("added: %d, modified: %d, removed: %d", added, modified, removed)
+	return nil
+}
 
-			todo.segment.Unlock()
+type location struct {
+	segment *Segment
+	id      int32
+	info    docInfo
+}
 
-			for k := range uniq {
-				delete(uniq, k)
+// where the live version of each document is, the newest one if a
+// document is live in more than one segment. the others are stale
+func knownDocuments(segments []*Segment) (map[string]location, []location) {
+	known := map[string]location{}
+	stale := []location{}
+	for _, s := range segments {
+		for id := int32(0); id < int32(s.forward.count()); id++ {
+			if !s.isDeleted(id) {
+				path, _ := s.forward.read(uint32(id))
+				if old, ok := known[path]; ok {
+					stale = append(stale, old)
+				}
+				known[path] = location{s, id, s.docInfo(id)}
 			}
-		case <-done:
-			return
 		}
 	}
+	return known, stale
+}
+
+// true if path is dir or in it. both are cleaned first, like the paths
+// filepath.Walk returns, so that ./src or src/../src are the same as src
+func isUnder(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// only files with one of the extensions of the options are indexed,
+// hidden files are skipped
+func (x *Indexer) isIndexable(f os.FileInfo) bool {
+	name := f.Name()
+	if strings.HasPrefix(name, ".") || f.IsDir() {
+		return false
+	}
+	return x.extensions[filepath.Ext(name)]
+}
+
+// a created segment that stores what the options say
+func (x *Indexer) createSegment() (*Segment, error) {
+	s, err := createSegment(x.name)
+	if err != nil {
+		return nil, err
+	}
+	s.positions = !x.options.NoPositions
+	s.hasTrigrams = !x.options.NoTrigrams
+	return s, nil
+}
+
+func (x *Indexer) newMemorySegment() *Segment {
+	s := NewMemorySegment()
+	s.positions = !x.options.NoPositions
+	s.hasTrigrams = !x.options.NoTrigrams
+	return s
 }
 
-func DoIndex(name string, args []string) {
+// indexes the files under args for which include returns true into new
+// segments, which are returned written and closed but not committed.
+// on error the segments written so far are removed
+func (x *Indexer) index(args []string, include func(string, os.FileInfo) bool) ([]*Segment, error) {
 	log.Printf("%#v\n", args)
 
-	maxproc := runtime.GOMAXPROCS(0)
+	maxproc := x.options.Workers
 
 	done := make(chan int)
 	workers := make(chan indexable)
 
 	inprogress := []*Segment{}
+	written := []*Segment{}
 	n := 0
-	current_n_segment := 0
 	stop := func() {
 		for i := 0; i < maxproc; i++ {
 			done <- 1
@@ -180,76 +685,89 @@ func DoIndex(name string, args []string) {
 	start := func() {
 		for i := 0; i < maxproc; i++ {
 			go func() {
-				tokenizeAndAdd(workers, done)
+				x.tokenizeAndAdd(workers, done)
 			}()
 		}
 	}
-	segments_at_a_time := 2
-	move := func(onlyflush bool) {
+	segments_at_a_time := x.options.SegmentsAtATime
+	move := func(onlyflush bool) error {
 		stop()
 
-		flushers := make(chan int)
+		flushers := make(chan error)
 		for _, s := range inprogress {
 			go func(seg *Segment) {
-				seg.flushToDisk()
+				err := seg.flushToDisk()
 				seg.close()
-				flushers <- 1
+				flushers <- err
 			}(s)
 		}
 
+		var err error
 		for range inprogress {
-			<-flushers
+			if e := <-flushers; e != nil {
+				err = e
+			}
 		}
 		close(flushers)
-
-		if !onlyflush {
-			inprogress = []*Segment{}
-			for i := current_n_segment; i < current_n_segment+segments_at_a_time; i++ {
-				s := path.Join(name,fmt.Sprintf("segment.%d", i))
-				if err := os.MkdirAll(s, 0755); err != nil {
-					panic(err)
+		inprogress = []*Segment{}
+
+		if err == nil && !onlyflush {
+			for i := 0; i < segments_at_a_time; i++ {
+				s, e := x.createSegment()
+				if e != nil {
+					err = e
+					break
 				}
-
-				log.Printf("creating new segment: %s", s)
-				inprogress = append(inprogress, NewSegment(s))
-
+				inprogress = append(inprogress, s)
+				written = append(written, s)
 			}
-			current_n_segment += segments_at_a_time
 		}
 		runtime.GC()
 		start()
+		return err
 	}
 
 	start()
-	move(false)
+	root := ""
 	walker := func(path string, f os.FileInfo, err error) error {
-		if f != nil {
-			name := f.Name()
-			if !strings.HasPrefix(name, ".") && !f.IsDir() {
-				ext := filepath.Ext(name)
-				if _, ok := ONLY[ext]; ok {
-					n++
-					if n > 1000 {
-						move(false)
-						n = 0
-					}
-
-					workers <- indexable{path, inprogress[rand.Intn(len(inprogress))]}
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+		if x.isIndexable(f) && include(path, f) {
+			n++
+			if n > x.options.SegmentDocs*segments_at_a_time || len(inprogress) == 0 {
+				if err := move(false); err != nil {
+					return err
 				}
+				n = 0
 			}
+
+			workers <- indexable{path, root, newDocInfo(f), inprogress[rand.Intn(len(inprogress))]}
 		}
 		return nil
 	}
 
+	var err error
 	for _, arg := range args {
-		if err := filepath.Walk(arg, walker); err != nil {
-			panic(err)
+		root = arg
+		if err = filepath.Walk(arg, walker); err != nil {
+			break
 		}
 	}
-	move(true)
+	if e := move(true); err == nil {
+		err = e
+	}
 	stop()
 	close(workers)
 	close(done)
 
+	if err != nil {
+		for _, s := range written {
+			os.RemoveAll(s.root)
+		}
+		return nil, err
+	}
 	log.Printf("done")
+	return written, nil
 }
@@ -0,0 +1,299 @@
+package index
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// bump whenever the layout of the manifest changes
+const MANIFEST_VERSION = 1
+
+// the commit point of an index: only the segments listed in the manifest
+// are loaded, a segment that was being written when zearch crashed is
+// not in it. every commit increments Generation, Next is the number of
+// the next segment to create
+type manifest struct {
+	Version    int
+	Generation int
+	Next       int
+	Segments   []string
+}
+
+func manifestPath(name string) string {
+	return path.Join(name, "manifest")
+}
+
+// nil if the index has no manifest yet
+func readManifest(name string) (*manifest, error) {
+	data, err := ioutil.ReadFile(manifestPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %s", manifestPath(name), err)
+	}
+	if m.Version != MANIFEST_VERSION {
+		return nil, fmt.Errorf("%s: unsupported manifest version %d, expected %d, reindex", manifestPath(name), m.Version, MANIFEST_VERSION)
+	}
+	return m, nil
+}
+
+// the segment directories of the index, indexes created before there
+// was a manifest have all segment.N directories
+func segmentDirs(name string) ([]string, error) {
+	m, err := readManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		dirs := []string{}
+		for _, s := range m.Segments {
+			dirs = append(dirs, path.Join(name, s))
+		}
+		return dirs, nil
+	}
+	return filepath.Glob(path.Join(name, "segment.*"))
+}
+
+// calls cb with the current manifest while holding an exclusive lock on
+// the index, if cb returns true the modified manifest is written to a
+// temporary file, synced and renamed over the old one
+func updateManifest(name string, cb func(m *manifest) bool) error {
+	if err := os.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+	lock, err := openFile(path.Join(name, "manifest.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	m, err := readManifest(name)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		// start from the segments of an index without manifest
+		dirs, err := segmentDirs(name)
+		if err != nil {
+			return err
+		}
+		m = &manifest{Version: MANIFEST_VERSION, Segments: []string{}}
+		for _, dir := range dirs {
+			m.Segments = append(m.Segments, path.Base(dir))
+			var n int
+			if _, err := fmt.Sscanf(path.Base(dir), "segment.%d", &n); err == nil && n >= m.Next {
+				m.Next = n + 1
+			}
+		}
+	}
+	if !cb(m) {
+		return nil
+	}
+	m.Generation++
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(manifestPath(name), data); err != nil {
+		return err
+	}
+	return syncDir(name, false)
+}
+
+// held by Index, Update and Merge while they run, so that a merge does
+// not miss the tombstones an update writes into its sources, or merge
+// away the segments an update or a new index is replacing. every writer
+// creates its segments while holding it, so the tmp.N directories found
+// once it is taken were left by a writer that failed and are removed.
+// waits for the other writers if wait is true and fails otherwise, call
+// the returned func to release it
+func lockWriter(name string, wait bool) (func(), error) {
+	if err := os.MkdirAll(name, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := openFile(path.Join(name, "write.lock"))
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(lock.Fd()), how); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s: the index is being written", name)
+		}
+		return nil, err
+	}
+	unlock := func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}
+
+	stale, err := filepath.Glob(path.Join(name, "tmp.*"))
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for _, dir := range stale {
+		log.Printf("removing %s, left by a failed writer", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// creates an empty segment in a temporary directory, it becomes part of
+// the index when it is committed
+func createSegment(name string) (*Segment, error) {
+	n := 0
+	err := updateManifest(name, func(m *manifest) bool {
+		n = m.Next
+		m.Next++
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	root := path.Join(name, fmt.Sprintf("tmp.%d", n))
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	log.Printf("creating new segment: %s", root)
+	return NewSegment(root)
+}
+
+// the directory a created segment is renamed to on commit
+func committedRoot(root string) (string, error) {
+	var n int
+	if _, err := fmt.Sscanf(path.Base(root), "tmp.%d", &n); err != nil {
+		return "", fmt.Errorf("%s: not a created segment", root)
+	}
+	return path.Join(path.Dir(root), fmt.Sprintf("segment.%d", n)), nil
+}
+
+// syncs the files of the written (and closed) segments in add, renames
+// them into place and atomically replaces the segments in remove with
+// them in the manifest. the directories of the removed segments are
+// deleted, a running server keeps using them until it is reloaded.
+// returns the directories add were renamed to
+func commit(name string, add []*Segment, remove []string) ([]string, error) {
+	roots := []string{}
+	// moves the segments renamed so far back to tmp.N, where the next
+	// writer deletes them, so that they are not taken for committed ones
+	rollback := func() {
+		for i, root := range roots {
+			if err := os.Rename(root, add[i].root); err != nil {
+				log.Print(err)
+				if err := os.RemoveAll(root); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+	for _, s := range add {
+		if err := syncDir(s.root, true); err != nil {
+			rollback()
+			return nil, err
+		}
+		root, err := committedRoot(s.root)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		if err := os.Rename(s.root, root); err != nil {
+			rollback()
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	if err := syncDir(name, false); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	err := updateManifest(name, func(m *manifest) bool {
+		removed := map[string]bool{}
+		for _, root := range remove {
+			removed[path.Base(root)] = true
+		}
+		segments := []string{}
+		for _, s := range m.Segments {
+			if !removed[s] {
+				segments = append(segments, s)
+			}
+		}
+		for _, root := range roots {
+			segments = append(segments, path.Base(root))
+		}
+		m.Segments = segments
+		return true
+	})
+	if err != nil {
+		// unless the manifest was written and only syncing it failed
+		written := false
+		if m, _ := readManifest(name); m != nil && len(roots) > 0 {
+			for _, s := range m.Segments {
+				written = written || s == path.Base(roots[0])
+			}
+		}
+		if !written {
+			rollback()
+		}
+		return nil, err
+	}
+
+	for _, root := range remove {
+		if err := os.RemoveAll(root); err != nil {
+			log.Print(err)
+		}
+	}
+	return roots, nil
+}
+
+func syncFile(name string) error {
+	fd, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
+
+// syncs dir, and the files in it if files is true
+func syncDir(dir string, files bool) error {
+	if files {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range infos {
+			if f.IsDir() {
+				continue
+			}
+			if err := syncFile(path.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return syncFile(dir)
+}
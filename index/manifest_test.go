@@ -0,0 +1,200 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	name := t.TempDir()
+	created := []*Segment{}
+	for i := 0; i < 2; i++ {
+		s, err := createSegment(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDocuments(s, map[string]string{"/src/net/udp.go": "func ListenUDP()"})
+		if err := s.flushToDisk(); err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		created = append(created, s)
+	}
+	roots, err := commit(name, created, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m.Segments) != "[segment.0 segment.1]" || m.Next != 2 || m.Generation != 3 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	if _, err := commit(name, nil, roots[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = readManifest(name); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m.Segments) != "[segment.1]" || m.Generation != 4 {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	if _, err := os.Stat(roots[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, actual %v", roots[0], err)
+	}
+
+	// left by a writer that failed
+	if err := os.MkdirAll(path.Join(name, "tmp.7"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := lockWriter(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockWriter(name, false); err == nil {
+		t.Fatalf("expected the writer lock to be held")
+	}
+	unlock()
+	if _, err := os.Stat(path.Join(name, "tmp.7")); !os.IsNotExist(err) {
+		t.Fatalf("expected tmp.7 to be removed, actual %v", err)
+	}
+}
+
+func count(t *testing.T, name string, query string) int {
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+	res, err := searcher.Search(context.Background(), query, SearchOptions{ExactCount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.FilesMatching
+}
+
+func TestUpdateCommitFails(t *testing.T) {
+	src := t.TempDir()
+	write := func(data string) {
+		if err := ioutil.WriteFile(path.Join(src, "a.go"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1})
+	write("func Alpha()")
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the new segment cannot be renamed into place, so no tombstone is
+	// saved and the old version stays
+	write("func Alpha(modified bool)")
+	m, err := readManifest(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := path.Join(name, fmt.Sprintf("segment.%d", m.Next))
+	if err := os.MkdirAll(path.Join(blocked, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Update([]string{src}); err == nil {
+		t.Fatalf("expected the commit to fail")
+	}
+	if n := count(t, name, "Alpha"); n != 1 {
+		t.Fatalf("expected the old version, actual %d files", n)
+	}
+
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, name, "Alpha"); n != 1 {
+		t.Fatalf("expected one version, actual %d files", n)
+	}
+	if n := count(t, name, "modified"); n != 1 {
+		t.Fatalf("expected the new version, actual %d files", n)
+	}
+	if stale, _ := filepath.Glob(path.Join(name, "tmp.*")); len(stale) != 0 {
+		t.Fatalf("expected no temporary segments, actual %v", stale)
+	}
+
+	// a crash after the commit leaves both versions, the next update
+	// deletes the stale one
+	write("func Alpha(crashed bool)")
+	written, err := indexer.index([]string{src}, func(string, os.FileInfo) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit(name, written, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, name, "Alpha"); n != 2 {
+		t.Fatalf("expected both versions, actual %d files", n)
+	}
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, name, "Alpha"); n != 1 {
+		t.Fatalf("expected the stale version to be deleted, actual %d files", n)
+	}
+}
+
+func TestCommitRenameFails(t *testing.T) {
+	name := t.TempDir()
+	created := []*Segment{}
+	for i := 0; i < 2; i++ {
+		s, err := createSegment(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addDocuments(s, map[string]string{"/src/net/udp.go": "func ListenUDP()"})
+		if err := s.flushToDisk(); err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		created = append(created, s)
+	}
+	// the second segment cannot be renamed into place, the first one is
+	// moved back
+	blocked, err := committedRoot(created[1].root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(blocked, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit(name, created, nil); err == nil {
+		t.Fatalf("expected the commit to fail")
+	}
+	if segments, _ := filepath.Glob(path.Join(name, "segment.*")); fmt.Sprint(segments) != fmt.Sprint([]string{blocked}) {
+		t.Fatalf("expected only %s, actual %v", blocked, segments)
+	}
+	for _, s := range created {
+		if _, err := os.Stat(s.root); err != nil {
+			t.Fatalf("expected %s to be left for the next writer: %v", s.root, err)
+		}
+	}
+	if m, err := readManifest(name); err != nil || (m != nil && len(m.Segments) != 0) {
+		t.Fatalf("unexpected manifest %+v, %v", m, err)
+	}
+
+	if err := os.RemoveAll(blocked); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := commit(name, created, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, name, "ListenUDP"); n != 2 {
+		t.Fatalf("expected 2 files, actual %d", n)
+	}
+}
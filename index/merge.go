@@ -0,0 +1,130 @@
+package index
+
+import (
+	"log"
+	"os"
+	"sort"
+)
+
+// segments with less live documents than this are merged together, up
+// to MERGE_MAX_DOCS documents per merged segment
+var MERGE_MAX_DOCS = 50000
+
+// segments with more deleted documents than this ratio are rewritten
+// even if there is nothing to merge them with
+var MERGE_DELETED_RATIO = 0.2
+
+func (s *Segment) liveCount() int {
+	return s.forward.count() - s.deletedCount()
+}
+
+// groups of segments that should be merged, small segments are packed
+// together in order of their live document count
+func mergePlan(segments []*Segment) [][]*Segment {
+	candidates := []*Segment{}
+	for _, s := range segments {
+		if s.liveCount() < MERGE_MAX_DOCS {
+			candidates = append(candidates, s)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].liveCount() < candidates[j].liveCount()
+	})
+
+	plan := [][]*Segment{}
+	group := []*Segment{}
+	docs := 0
+	flush := func() {
+		if len(group) > 1 || (len(group) == 1 && float64(group[0].deletedCount()) > MERGE_DELETED_RATIO*float64(group[0].forward.count())) {
+			plan = append(plan, group)
+		}
+		group = []*Segment{}
+		docs = 0
+	}
+	for _, s := range candidates {
+		if docs+s.liveCount() > MERGE_MAX_DOCS {
+			flush()
+		}
+		group = append(group, s)
+		docs += s.liveCount()
+	}
+	flush()
+	return plan
+}
+
+func copyPostings(dst map[string][]posting, dictionary *StoredStringArray, postings *MMaped, positional bool, remap []int32) {
+	p := postingsIterator{}
+	for i := uint32(0); i < uint32(dictionary.count()); i++ {
+		term, _ := dictionary.read(i)
+		p.reset(postingsAt(postings, dictionary.extra(i)), positional)
+		for p.next() {
+			if id := remap[p.doc()]; id != -1 {
+				dst[term] = append(dst[term], posting{id, p.tf(), p.positions(nil)})
+			}
+		}
+	}
+}
+
+// writes the live documents of the sources into dst
+func mergeSegments(dst *Segment, sources []*Segment) error {
+	for _, s := range sources {
+		dst.positions = dst.positions && s.positions
+		dst.hasTrigrams = dst.hasTrigrams && s.hasTrigrams
+	}
+
+	for _, s := range sources {
+		remap := make([]int32, s.forward.count())
+		for id := range remap {
+			remap[id] = -1
+			if !s.isDeleted(int32(id)) {
+				doc, _ := s.forward.read(uint32(id))
+				remap[id] = dst.addForward(doc, s.docLength(int32(id)), s.docInfo(int32(id)))
+			}
+		}
+		copyPostings(dst.inmemoryInverted, s.inverted, s.postings, s.positions, remap)
+		if dst.hasTrigrams {
+			copyPostings(dst.inmemoryTrigrams, s.trigrams, s.trigramPostings, false, remap)
+		}
+	}
+	defer dst.close()
+	return dst.flushToDisk()
+}
+
+// merges the segments of the index according to mergePlan. each merged
+// segment replaces its sources in one commit. a running server keeps
+// using the old segments until it is reloaded
+func Merge(name string) error {
+	unlock, err := lockWriter(name, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	index, err := NewIndex(name)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	for _, group := range mergePlan(index.segments) {
+		dst, err := createSegment(name)
+		if err != nil {
+			return err
+		}
+		docs := 0
+		remove := []string{}
+		for _, s := range group {
+			docs += s.liveCount()
+			remove = append(remove, s.root)
+		}
+		log.Printf("merging %d segments with %d documents into %s", len(group), docs, dst.root)
+		if err := mergeSegments(dst, group); err != nil {
+			os.RemoveAll(dst.root)
+			return err
+		}
+		if _, err := commit(name, []*Segment{dst}, remove); err != nil {
+			return err
+		}
+	}
+	return nil
+}
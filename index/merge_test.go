@@ -0,0 +1,88 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestMerge(t *testing.T) {
+	src := t.TempDir()
+	write := func(name string, data string) {
+		if err := ioutil.WriteFile(path.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1})
+	write("a.go", "func Alpha()")
+	write("b.go", "func Beta()")
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	write("c.go", "func Gamma()")
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	write("a.go", "func Alpha(modified bool)")
+	if err := os.Remove(path.Join(src, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+
+	// merge waits for the update that holds the writer lock
+	unlock, err := lockWriter(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := make(chan error)
+	go func() { merged <- Merge(name) }()
+	select {
+	case err := <-merged:
+		t.Fatalf("merged while the writer lock was held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if err := <-merged; err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := segmentDirs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("expected one merged segment, actual %v", dirs)
+	}
+	broken, err := Check(name, false, func(root string, problems []string) {
+		if len(problems) != 0 {
+			t.Errorf("%s: %v", root, problems)
+		}
+	})
+	if err != nil || broken != 0 {
+		t.Fatalf("expected no broken segments, actual %d, %v", broken, err)
+	}
+
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+	if files, _ := searcher.index.Stats(); files != 2 {
+		t.Fatalf("expected 2 live files, actual %d", files)
+	}
+	for query, expected := range map[string]int{"Alpha": 1, "modified": 1, "Beta": 0, "Gamma": 1} {
+		res, err := searcher.Search(context.Background(), query, SearchOptions{ExactCount: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.FilesMatching != expected {
+			t.Errorf("%s: expected %d files, actual %v", query, expected, res.Hits)
+		}
+	}
+}
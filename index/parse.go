@@ -0,0 +1,416 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+)
+
+// query syntax:
+//
+//   query   := or
+//   or      := and ( "OR" and )*
+//   and     := unary ( [ "AND" ] unary )*
+//   unary   := [ "-" ] primary
+//   primary := "(" or ")" | '"' words '"' | "/" regexp "/" | field ":" word | word
+//
+// words are split with Tokenize (or the tokenizer of ParseWithTokenizer),
+// so `atomic.go` is the same as `atomic AND go`. quoted words have to
+// appear next to each other, in the same order.
+// words without a field match any of the DEFAULT_FIELDS, `path:net/ipv4`
+// matches only files with both net and ipv4 in their directory.
+// words with a * match every term that fits, `Atomic*` finds AtomicInt and
+// AtomicBool, see WildcardQuery. words ending with ~ (or ~1, ~2 for the
+// number of edits) also match terms with typos, see FuzzyQuery.
+// regexps are matched against each line of the candidate files
+
+const (
+	tokenEOF = iota
+	tokenWord
+	tokenQuoted
+	tokenMinus
+	tokenOpen
+	tokenClose
+	tokenAnd
+	tokenOr
+	tokenRegexp
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of query"
+	case tokenQuoted:
+		return fmt.Sprintf("%q", t.text)
+	case tokenRegexp:
+		return fmt.Sprintf("/%s/", t.text)
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+func lex(input string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(input[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote at position %d", i)
+			}
+			tokens = append(tokens, token{tokenQuoted, input[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '/':
+			end := i + 1
+			for end < len(input) && input[end] != '/' {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated regexp at position %d", i)
+			}
+			tokens = append(tokens, token{tokenRegexp, strings.Replace(input[i+1:end], "\\/", "/", -1), i})
+			i = end + 1
+		case c == '-':
+			tokens = append(tokens, token{tokenMinus, "-", i})
+			i++
+		default:
+			start := i
+			for i < len(input) && strings.IndexByte(" \t\n\r()\"", input[i]) == -1 {
+				i++
+			}
+			word := input[start:i]
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{tokenAnd, word, start})
+			case "OR":
+				tokens = append(tokens, token{tokenOr, word, start})
+			default:
+				tokens = append(tokens, token{tokenWord, word, start})
+			}
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(input)}), nil
+}
+
+type parser struct {
+	tokens   []token
+	pos      int
+	tokenize func(input string, cb func(text string, weird int))
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (Query, error) {
+	queries := []Query{}
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if q != nil {
+			queries = append(queries, q)
+		}
+		if p.peek().kind != tokenOr {
+			break
+		}
+		p.next()
+	}
+	switch len(queries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return queries[0], nil
+	}
+	return NewBoolOrQuery(queries), nil
+}
+
+func (p *parser) parseAnd() (Query, error) {
+	must := []Query{}
+	mustNot := []Query{}
+	start := p.peek()
+	for {
+		t := p.peek()
+		if t.kind == tokenEOF || t.kind == tokenClose || t.kind == tokenOr {
+			break
+		}
+		if t.kind == tokenAnd {
+			p.next()
+			continue
+		}
+
+		negate := false
+		if t.kind == tokenMinus {
+			p.next()
+			negate = true
+		}
+		q, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		if q == nil {
+			continue
+		}
+		if negate {
+			mustNot = append(mustNot, q)
+		} else {
+			must = append(must, q)
+		}
+	}
+
+	var q Query
+	switch len(must) {
+	case 0:
+		if len(mustNot) > 0 {
+			return nil, fmt.Errorf("nothing to exclude from at position %d, add at least one term that is not negated", start.pos)
+		}
+		return nil, nil
+	case 1:
+		q = must[0]
+	default:
+		q = NewBoolAndQuery(must)
+	}
+	if len(mustNot) > 0 {
+		q = NewBoolNotQuery(q, mustNot)
+	}
+	return q, nil
+}
+
+func (p *parser) parsePrimary() (Query, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenOpen:
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf("expected ')' to match '(' at position %d, got %s", t.pos, closing)
+		}
+		return q, nil
+	case tokenWord:
+		field, text := "", t.text
+		if i := strings.IndexByte(t.text, ':'); i > 0 && FIELDS[t.text[:i]] {
+			if i == len(t.text)-1 {
+				return nil, fmt.Errorf("missing value for %s at position %d", t, t.pos)
+			}
+			field, text = t.text[:i], t.text[i+1:]
+		}
+		if i := strings.LastIndexByte(text, '~'); i > 0 && isDistance(text[i+1:]) {
+			return p.fuzzyQuery(field, text[:i], text[i+1:], t.pos)
+		}
+		if strings.IndexByte(text, '*') != -1 {
+			return p.wildcardsQuery(field, text, t.pos)
+		}
+		if field != "" {
+			return p.fieldQuery(field, text), nil
+		}
+		return p.termsQuery(text), nil
+	case tokenQuoted:
+		return p.phraseQuery(t.text), nil
+	case tokenRegexp:
+		q, err := NewRegexpQuery(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp at position %d: %s", t.pos, err)
+		}
+		return q, nil
+	}
+	return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+}
+
+func and(queries []Query) Query {
+	switch len(queries) {
+	case 0:
+		return nil
+	case 1:
+		return queries[0]
+	}
+	return NewBoolAndQuery(queries)
+}
+
+// query (e.g. termQuery) for text in each of the DEFAULT_FIELDS
+func anyFieldQuery(text string, query func(field string, text string) Query) Query {
+	queries := []Query{}
+	for _, field := range DEFAULT_FIELDS {
+		queries = append(queries, query(field, text))
+	}
+	if len(queries) == 1 {
+		return queries[0]
+	}
+	return NewBoolOrQuery(queries)
+}
+
+func termQuery(field string, text string) Query {
+	return NewFieldTerm(field, text)
+}
+
+func wildcardQuery(field string, pattern string) Query {
+	return NewWildcardQuery(field, pattern)
+}
+
+func (p *parser) termsQuery(text string) Query {
+	queries := []Query{}
+	p.tokenize(text, func(text string, weird int) {
+		queries = append(queries, anyFieldQuery(text, termQuery))
+	})
+	return and(queries)
+}
+
+// like termsQuery, or fieldQuery if field is not empty, but the words
+// with a * are wildcards. the parts of a wildcard between the * are
+// split with the tokenizer too, it must not split them further
+func (p *parser) wildcardsQuery(field string, text string, pos int) (Query, error) {
+	queries := []Query{}
+	add := func(word string, query func(field string, text string) Query) {
+		if field == "" {
+			queries = append(queries, anyFieldQuery(word, query))
+		} else {
+			queries = append(queries, query(field, word))
+		}
+	}
+	words := strings.FieldsFunc(text, func(c rune) bool { return !isTokenChar(c) && c != '*' })
+	for _, word := range words {
+		if strings.IndexByte(word, '*') == -1 {
+			p.tokenize(word, func(text string, weird int) {
+				add(text, termQuery)
+			})
+			continue
+		}
+		if err := checkWildcard(word, pos); err != nil {
+			return nil, err
+		}
+		parts := strings.Split(word, "*")
+		for i, part := range parts {
+			tokens := []string{}
+			p.tokenize(part, func(text string, weird int) {
+				tokens = append(tokens, text)
+			})
+			if part != "" && len(tokens) != 1 {
+				return nil, fmt.Errorf("wildcard %s at position %d is split by the tokenizer", word, pos)
+			}
+			if len(tokens) == 1 {
+				parts[i] = tokens[0]
+			}
+		}
+		add(strings.Join(parts, "*"), wildcardQuery)
+	}
+	return and(queries), nil
+}
+
+func (p *parser) fieldQuery(field string, text string) Query {
+	queries := []Query{}
+	p.tokenize(text, func(text string, weird int) {
+		queries = append(queries, NewFieldTerm(field, text))
+	})
+	return and(queries)
+}
+
+// like termsQuery, or fieldQuery if field is not empty, but every word
+// is fuzzy with distance edits, or fuzzyDistance if it is empty
+func (p *parser) fuzzyQuery(field string, text string, distance string, pos int) (Query, error) {
+	if strings.IndexByte(text, '*') != -1 {
+		return nil, fmt.Errorf("fuzzy word %s~%s at position %d cannot have a *", text, distance, pos)
+	}
+	if distance != "" && distance != "0" && distance != "1" && distance != "2" {
+		return nil, fmt.Errorf("fuzzy word %s~%s at position %d can have at most 2 edits", text, distance, pos)
+	}
+	queries := []Query{}
+	p.tokenize(text, func(text string, weird int) {
+		d := fuzzyDistance(text)
+		if distance != "" {
+			d = int(distance[0] - '0')
+		}
+		query := func(field string, text string) Query {
+			return NewFuzzyQuery(field, text, d)
+		}
+		if field == "" {
+			queries = append(queries, anyFieldQuery(text, query))
+		} else {
+			queries = append(queries, query(field, text))
+		}
+	})
+	return and(queries), nil
+}
+
+// the number after the ~ of a fuzzy word, or nothing
+func isDistance(text string) bool {
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// tokens with up to 2 characters are not indexed, they are skipped but
+// still count for the offsets of the words after them
+func (p *parser) phraseQuery(text string) Query {
+	terms := []*Term{}
+	offsets := []uint32{}
+	pos := uint32(0)
+	p.tokenize(text, func(text string, weird int) {
+		if len(text) > 2 {
+			terms = append(terms, NewTerm(text))
+			offsets = append(offsets, pos)
+		}
+		pos++
+	})
+	switch len(terms) {
+	case 0:
+		return nil
+	case 1:
+		return terms[0]
+	}
+	return NewPhraseQuery(terms, offsets)
+}
+
+// parses the query syntax described above, an empty query matches nothing
+func Parse(input string) (Query, error) {
+	return ParseWithTokenizer(input, Tokenize)
+}
+
+// like Parse, but the words are split with tokenize, which should be the
+// Tokenizer of the IndexerOptions the index was written with
+func ParseWithTokenizer(input string, tokenize func(input string, cb func(text string, weird int))) (Query, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, tokenize: tokenize}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+	}
+	if q == nil {
+		return NewBoolAndQuery([]Query{}), nil
+	}
+	return q, nil
+}
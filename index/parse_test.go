@@ -0,0 +1,85 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+)
+
+// a word without field, matched against DEFAULT_FIELDS
+func w(text string) string {
+	return fmt.Sprintf("(%s OR file:%s OR path:%s OR ext:%s)", text, text, text, text)
+}
+
+var parseTests = []struct {
+	input    string
+	expected string
+}{
+	{"", "()"},
+	{"udp", w("udp")},
+	{"udp ipv4", "(" + w("udp") + " AND " + w("ipv4") + ")"},
+	{"udp AND ipv4", "(" + w("udp") + " AND " + w("ipv4") + ")"},
+	{"atomic.go", "(" + w("atomic") + " AND " + w("go") + ")"},
+	{"udp -java", "(" + w("udp") + " -" + w("java") + ")"},
+	{"udp -java -test", "(" + w("udp") + " -" + w("java") + " -" + w("test") + ")"},
+	{"mutex OR rwlock", "(" + w("mutex") + " OR " + w("rwlock") + ")"},
+	{"(mutex OR rwlock) AND segment", "((" + w("mutex") + " OR " + w("rwlock") + ") AND " + w("segment") + ")"},
+	{"a b OR c", "((" + w("a") + " AND " + w("b") + ") OR " + w("c") + ")"},
+	{"a -(b OR c)", "(" + w("a") + " -(" + w("b") + " OR " + w("c") + "))"},
+	{`"func main" -test`, `("func main" -` + w("test") + ")"},
+	{`"if err != nil"`, `"err nil"`},
+	{`"main"`, "main"},
+	{"foo-bar", "(" + w("foo") + " AND " + w("bar") + ")"},
+	{"+++", "()"},
+	{"path:ipv4 ext:c udp", "(path:ipv4 AND ext:c AND " + w("udp") + ")"},
+	{"path:net/ipv4", "(path:net AND path:ipv4)"},
+	{"content:udp -repo:linux file:udp", "((udp AND file:udp) -repo:linux)"},
+	{"std::vector", w("std::vector")},
+	{`/func\s+main/ -test`, `(/func\s+main/ -` + w("test") + ")"},
+	{`/a\/b/`, `/a/b/`},
+	{"Atomic*", w("Atomic*")},
+	{"atomic.Load*Int", "(" + w("atomic") + " AND " + w("Load*Int") + ")"},
+	{"file:atom*", "file:atom*"},
+	{"path:net/ip*", "(path:net AND path:ip*)"},
+	{"AtomicLnog~", w("AtomicLnog~2")},
+	{"Lnog~", w("Lnog~1")},
+	{"file:udp~2", "file:udp~2"},
+	{"atomic.Lnog~1", "(" + w("atomic~1") + " AND " + w("Lnog~1") + ")"},
+	{"~Foo", w("Foo")},
+	{"a~b", "(" + w("a") + " AND " + w("b") + ")"},
+}
+
+var parseErrorTests = []string{
+	"(udp",
+	"udp)",
+	`"udp`,
+	"-udp",
+	"udp OR -java",
+	"udp -",
+	"path:",
+	"/abc",
+	"/a(b/",
+	"*Conn",
+	"file:*",
+	"Atomic*~",
+	"foo~3",
+	"file:udp~12",
+}
+
+func TestParse(t *testing.T) {
+	for _, tt := range parseTests {
+		q, err := Parse(tt.input)
+		if err != nil {
+			t.Errorf("%#v: unexpected error %s", tt.input, err)
+			continue
+		}
+		if actual := fmt.Sprintf("%s", q); actual != tt.expected {
+			t.Errorf("%#v: expected %s, actual %s", tt.input, tt.expected, actual)
+		}
+	}
+
+	for _, input := range parseErrorTests {
+		if q, err := Parse(input); err == nil {
+			t.Errorf("%#v: expected error, got %s", input, q)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package index
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const POSTINGS_BLOCK_SIZE = 128
+
+// bytes per block in the skip table
+const SKIP_SIZE = 16
+
+type posting struct {
+	id        int32
+	tf        uint32
+	positions []uint32
+}
+
+// on disk a posting list looks like:
+//
+//	uvarint number of postings
+//	uvarint number of blocks
+//	uvarint max tf, uvarint min document length of all postings
+//	skip table, 16 bytes per block: last doc id in the block, offset of the block,
+//	  max tf and min document length in the block
+//	blocks with up to POSTINGS_BLOCK_SIZE entries of uvarint doc id delta, uvarint tf
+//	and in segments with positions: uvarint length in bytes, uvarint position deltas
+//
+// the first delta of each block is relative to the last doc id of the
+// previous block, so any block can be decoded without touching the others.
+// the max tf and min length give an upper bound of the score of the
+// documents in the list or in a block, to skip those that cannot make it
+// into the top hits. lengths are the document lengths by id, nil if the
+// score does not depend on them
+func encodePostings(values []posting, positional bool, lengths []uint32) []byte {
+	nblocks := (len(values) + POSTINGS_BLOCK_SIZE - 1) / POSTINGS_BLOCK_SIZE
+
+	skips := make([]byte, nblocks*SKIP_SIZE)
+	blocks := []byte{}
+	tmp := make([]byte, binary.MaxVarintLen32)
+	prev := uint32(0)
+	maxTf, minLength := uint32(0), uint32(0)
+	blockMaxTf, blockMinLength := uint32(0), uint32(0)
+	for i, v := range values {
+		block := i / POSTINGS_BLOCK_SIZE
+		if i%POSTINGS_BLOCK_SIZE == 0 {
+			putUint32Off(skips, block*SKIP_SIZE+4, uint32(len(blocks)))
+			blockMaxTf, blockMinLength = 0, math.MaxUint32
+		}
+		length := uint32(0)
+		if int(v.id) < len(lengths) {
+			length = lengths[v.id]
+		}
+		if v.tf > blockMaxTf {
+			blockMaxTf = v.tf
+		}
+		if length < blockMinLength {
+			blockMinLength = length
+		}
+		blocks = append(blocks, tmp[:binary.PutUvarint(tmp, uint64(uint32(v.id)-prev))]...)
+		blocks = append(blocks, tmp[:binary.PutUvarint(tmp, uint64(v.tf))]...)
+		if positional {
+			encoded := []byte{}
+			last := uint32(0)
+			for _, pos := range v.positions {
+				encoded = append(encoded, tmp[:binary.PutUvarint(tmp, uint64(pos-last))]...)
+				last = pos
+			}
+			blocks = append(blocks, tmp[:binary.PutUvarint(tmp, uint64(len(encoded)))]...)
+			blocks = append(blocks, encoded...)
+		}
+		prev = uint32(v.id)
+		if i%POSTINGS_BLOCK_SIZE == POSTINGS_BLOCK_SIZE-1 || i == len(values)-1 {
+			putUint32Off(skips, block*SKIP_SIZE, prev)
+			putUint32Off(skips, block*SKIP_SIZE+8, blockMaxTf)
+			putUint32Off(skips, block*SKIP_SIZE+12, blockMinLength)
+			if block == 0 || blockMaxTf > maxTf {
+				maxTf = blockMaxTf
+			}
+			if block == 0 || blockMinLength < minLength {
+				minLength = blockMinLength
+			}
+		}
+	}
+
+	header := make([]byte, binary.MaxVarintLen64*4)
+	n := binary.PutUvarint(header, uint64(len(values)))
+	n += binary.PutUvarint(header[n:], uint64(nblocks))
+	n += binary.PutUvarint(header[n:], uint64(maxTf))
+	n += binary.PutUvarint(header[n:], uint64(minLength))
+	return append(append(header[:n], skips...), blocks...)
+}
+
+type postingsIterator struct {
+	count      int
+	nblocks    int
+	maxTf      uint32
+	minLength  uint32
+	skips      []byte
+	blocks     []byte
+	block      int
+	inblock    int
+	off        int
+	docId      uint32
+	freq       uint32
+	positional bool
+	posOff     int
+	posLen     int
+}
+
+func (p *postingsIterator) reset(b []byte, positional bool) {
+	p.positional = positional
+	off := 0
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(b[off:])
+		off += n
+		return v
+	}
+	p.count = int(uvarint())
+	p.nblocks = int(uvarint())
+	p.maxTf = uint32(uvarint())
+	p.minLength = uint32(uvarint())
+	p.skips = b[off : off+p.nblocks*SKIP_SIZE]
+	p.blocks = b[off+p.nblocks*SKIP_SIZE:]
+	p.enterBlock(0)
+}
+
+func (p *postingsIterator) blockLast(i int) uint32 {
+	return getUint32(p.skips, uint32(i*SKIP_SIZE))
+}
+
+func (p *postingsIterator) blockMaxTf(i int) uint32 {
+	return getUint32(p.skips, uint32(i*SKIP_SIZE+8))
+}
+
+func (p *postingsIterator) blockMinLength(i int) uint32 {
+	return getUint32(p.skips, uint32(i*SKIP_SIZE+12))
+}
+
+// the first block from the current one whose last doc is >= target,
+// nblocks if there is none
+func (p *postingsIterator) findBlock(target uint32) int {
+	start := p.block
+	end := p.nblocks
+	for start < end {
+		mid := start + ((end - start) / 2)
+		if p.blockLast(mid) < target {
+			start = mid + 1
+		} else {
+			end = mid
+		}
+	}
+	return start
+}
+
+func (p *postingsIterator) blockSize(i int) int {
+	if i == p.nblocks-1 {
+		return p.count - i*POSTINGS_BLOCK_SIZE
+	}
+	return POSTINGS_BLOCK_SIZE
+}
+
+func (p *postingsIterator) enterBlock(i int) {
+	p.block = i
+	p.inblock = 0
+	p.docId = 0
+	if i > 0 && i <= p.nblocks {
+		p.docId = p.blockLast(i - 1)
+	}
+	if i < p.nblocks {
+		p.off = int(getUint32(p.skips, uint32(i*SKIP_SIZE+4)))
+	}
+}
+
+func (p *postingsIterator) doc() uint32 {
+	return p.docId
+}
+
+func (p *postingsIterator) tf() uint32 {
+	return p.freq
+}
+
+func (p *postingsIterator) next() bool {
+	if p.block >= p.nblocks {
+		return false
+	}
+	if p.inblock == p.blockSize(p.block) {
+		p.enterBlock(p.block + 1)
+		if p.block >= p.nblocks {
+			return false
+		}
+	}
+	delta, n := binary.Uvarint(p.blocks[p.off:])
+	p.off += n
+	freq, m := binary.Uvarint(p.blocks[p.off:])
+	p.off += m
+	if p.positional {
+		plen, k := binary.Uvarint(p.blocks[p.off:])
+		p.off += k
+		p.posOff = p.off
+		p.posLen = int(plen)
+		p.off += p.posLen
+	}
+	p.docId += uint32(delta)
+	p.freq = uint32(freq)
+	p.inblock++
+	return true
+}
+
+// appends the token positions of the current doc to buf
+func (p *postingsIterator) positions(buf []uint32) []uint32 {
+	if !p.positional {
+		return buf
+	}
+	last := uint32(0)
+	for off := p.posOff; off < p.posOff+p.posLen; {
+		delta, n := binary.Uvarint(p.blocks[off:])
+		off += n
+		last += uint32(delta)
+		buf = append(buf, last)
+	}
+	return buf
+}
+
+// moves to the first posting with doc >= target, using the skip table
+// to jump over whole blocks
+func (p *postingsIterator) advance(target uint32) bool {
+	if p.block >= p.nblocks {
+		return false
+	}
+	if p.inblock > 0 && p.doc() >= target {
+		return true
+	}
+	if p.blockLast(p.block) < target {
+		p.enterBlock(p.findBlock(target))
+	}
+	for p.next() {
+		if p.doc() >= target {
+			return true
+		}
+	}
+	return false
+}
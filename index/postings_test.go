@@ -0,0 +1,71 @@
+package index
+
+import "testing"
+
+func makePostings(n int, step int) []posting {
+	values := []posting{}
+	for i := 0; i < n; i++ {
+		values = append(values, posting{int32(i * step), uint32(i * 1000), []uint32{uint32(i), uint32(i + 5), uint32(i * 100)}})
+	}
+	return values
+}
+
+func eq_uint32(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPostingsNext(t *testing.T) {
+	for _, n := range []int{0, 1, POSTINGS_BLOCK_SIZE - 1, POSTINGS_BLOCK_SIZE, POSTINGS_BLOCK_SIZE*3 + 7} {
+		values := makePostings(n, 3)
+		p := postingsIterator{}
+		p.reset(encodePostings(values, true, nil), true)
+		if p.count != n {
+			t.Errorf("expected count %d, actual %d", n, p.count)
+		}
+		i := 0
+		for p.next() {
+			if p.doc() != uint32(values[i].id) || p.tf() != values[i].tf {
+				t.Errorf("n: %d, expected %#v at %d, actual %d:%d", n, values[i], i, p.doc(), p.tf())
+			}
+			if positions := p.positions(nil); !eq_uint32(positions, values[i].positions) {
+				t.Errorf("n: %d, expected positions %#v at %d, actual %#v", n, values[i].positions, i, positions)
+			}
+			i++
+		}
+		if i != n {
+			t.Errorf("expected %d postings, actual %d", n, i)
+		}
+	}
+}
+
+func TestPostingsAdvance(t *testing.T) {
+	values := makePostings(1000, 5)
+	values = append(values, posting{1 << 30, 1 << 20, nil})
+	p := postingsIterator{}
+	p.reset(encodePostings(values, false, nil), false)
+
+	for _, target := range []uint32{0, 3, 5, 641, 642, 2500, 4995} {
+		if !p.advance(target) {
+			t.Fatalf("expected to find doc >= %d", target)
+		}
+		expected := ((target + 4) / 5) * 5
+		if p.doc() != expected {
+			t.Errorf("advance(%d): expected %d, actual %d", target, expected, p.doc())
+		}
+	}
+	if !p.advance(4996) || p.doc() != 1<<30 || p.tf() != 1<<20 {
+		t.Errorf("expected wide doc id and tf, got %d:%d", p.doc(), p.tf())
+	}
+	if p.advance(1<<30 + 1) {
+		t.Errorf("expected no more postings, got %d", p.doc())
+	}
+}
@@ -1,8 +1,10 @@
 package index
 
 import (
+	"fmt"
 	"math"
 	"sort"
+	"strings"
 )
 
 const (
@@ -15,9 +17,20 @@ type Query interface {
 	Next() int32
 	GetDocId() int32
 	AddSubQuery(Query)
-	Score() int64
+	Score() float64
 	Cost() uint32
 	Prepare(*Segment)
+	// a copy of the query tree without the cursor state, to run the
+	// same query on another segment at the same time
+	Clone() Query
+	// upper bounds of Score in the prepared segment, and for the
+	// documents from target up to the returned doc id
+	maxScore() float64
+	blockMaxScore(target int32) (float64, int32)
+	// documents that score less than min can be skipped, min only
+	// increases until the next Prepare. true if matching documents are
+	// skipped from then on
+	setMinScore(min float64) bool
 }
 
 type QueryBase struct {
@@ -29,9 +42,16 @@ func (q *QueryBase) GetDocId() int32 {
 }
 
 type Term struct {
-	cursor   int32
-	postings []byte
+	postings postingsIterator
 	term     string
+	field    string
+	text     string
+	scoring  int
+	// multiplies the score, lower for the more distant terms of a
+	// FuzzyQuery
+	boost   float64
+	segment *Segment
+	idf     float64
 	QueryBase
 }
 
@@ -39,72 +59,136 @@ func (t *Term) AddSubQuery(q Query) {
 	// noop
 }
 
+func (t *Term) Clone() Query {
+	return t.clone()
+}
+
+func (t *Term) clone() *Term {
+	return &Term{
+		term:      t.term,
+		field:     t.field,
+		text:      t.text,
+		scoring:   t.scoring,
+		boost:     t.boost,
+		QueryBase: QueryBase{NOT_READY},
+	}
+}
+
 func (t *Term) Prepare(s *Segment) {
-	t.cursor = 0
 	t.docId = NOT_READY
-	t.postings = s.findPostingsList(t.term)
+	t.segment = s
+	if t.field == FIELD_TRIGRAM {
+		t.postings.reset(s.findTrigramPostingsList(t.text), false)
+	} else {
+		t.postings.reset(s.findPostingsList(t.term), s.positions)
+	}
+	n := float64(s.forward.count())
+	df := float64(t.postings.count)
+	t.idf = math.Log(1 + (n-df+0.5)/(df+0.5))
 }
 
 func (t *Term) Cost() uint32 {
-	return uint32(len(t.postings) / 4)
+	return uint32(t.postings.count)
 }
 
-func (t *Term) Score() int64 {
-	return int64(1) + int64(t.getAt(t.cursor)&0x3FF)
+func (t *Term) Score() float64 {
+	length := uint32(0)
+	if t.field == FIELD_CONTENT && t.scoring != SCORING_COUNT {
+		length = t.segment.docLength(t.docId)
+	}
+	return t.score(t.postings.tf(), length)
+}
+
+// grows with tf and shrinks with length, so the max tf and min length of
+// the postings give an upper bound
+func (t *Term) score(freq uint32, length uint32) float64 {
+	tf := float64(freq)
+	if t.scoring == SCORING_COUNT {
+		return t.boost * (1 + tf)
+	}
+
+	// only content terms are normalized by the document length
+	norm := 1.0
+	if t.field == FIELD_CONTENT && t.segment.avgLength > 0 {
+		norm = float64(length) / t.segment.avgLength
+	}
+	return t.boost * t.idf * tf * (BM25_K1 + 1) / (tf + BM25_K1*(1-BM25_B+BM25_B*norm))
+}
+
+func (t *Term) maxScore() float64 {
+	if t.postings.count == 0 {
+		return 0
+	}
+	return t.score(t.postings.maxTf, t.postings.minLength)
+}
+
+func (t *Term) blockMaxScore(target int32) (float64, int32) {
+	p := &t.postings
+	if t.docId == NO_MORE || p.block >= p.nblocks {
+		return 0, NO_MORE
+	}
+	b := p.findBlock(uint32(target))
+	if b >= p.nblocks {
+		return 0, NO_MORE
+	}
+	return t.score(p.blockMaxTf(b), p.blockMinLength(b)), int32(p.blockLast(b))
+}
+
+func (t *Term) setMinScore(min float64) bool {
+	// noop
+	return false
+}
+
+func (t *Term) String() string {
+	if t.field == FIELD_CONTENT {
+		return t.text
+	}
+	if t.field == FIELD_TRIGRAM {
+		return fmt.Sprintf("trigram:%q", t.text)
+	}
+	return t.field + ":" + t.text
 }
 
 func NewTerm(term string) *Term {
+	return NewFieldTerm(FIELD_CONTENT, term)
+}
+
+// term from the trigram index of the segment
+func NewTrigramTerm(trigram string) *Term {
+	return NewFieldTerm(FIELD_TRIGRAM, trigram)
+}
+
+func NewFieldTerm(field string, term string) *Term {
 	return &Term{
-		cursor:    0,
-		term:      term,
+		term:      fieldTerm(field, term),
+		field:     field,
+		text:      term,
+		scoring:   DEFAULT_SCORING,
+		boost:     1,
 		QueryBase: QueryBase{NOT_READY},
 	}
 }
 
-func (t *Term) getAt(idx int32) uint32 {
-	return getUint32(t.postings, uint32(idx*4))
-}
 func (t *Term) advance(target int32) int32 {
 	if t.docId == NO_MORE || t.docId == target || target == NO_MORE {
 		t.docId = target
 		return t.docId
 	}
-	start := t.cursor
-	end := int32(len(t.postings) / 4)
-	for start < end {
-		mid := start + ((end - start) / 2)
-		current := int32(t.getAt(mid) >> 10)
-		if current == target {
-			t.cursor = mid
-			t.docId = target
-			return t.GetDocId()
-		}
-
-		if current < target {
-			start = mid + 1
-		} else {
-			end = mid
-		}
-	}
-
-	return t.move(start)
-}
-
-func (t *Term) move(to int32) int32 {
-	t.cursor = to
-	if t.cursor >= int32(len(t.postings)/4) {
-		t.docId = NO_MORE
+	if t.postings.advance(uint32(target)) {
+		t.docId = int32(t.postings.doc())
 	} else {
-		t.docId = int32(t.getAt(t.cursor) >> 10)
+		t.docId = NO_MORE
 	}
 	return t.docId
 }
 
 func (t *Term) Next() int32 {
-	if t.docId != NOT_READY {
-		t.cursor++
+	if t.postings.next() {
+		t.docId = int32(t.postings.doc())
+	} else {
+		t.docId = NO_MORE
 	}
-	return t.move(t.cursor)
+	return t.docId
 }
 
 type BoolQueryBase struct {
@@ -130,11 +214,55 @@ func (s ByCost) Less(i, j int) bool {
 	return s[i].Cost() < s[j].Cost()
 }
 
+func (q *BoolQueryBase) maxScore() float64 {
+	total := float64(0)
+	for _, sub := range q.queries {
+		total += sub.maxScore()
+	}
+	return total
+}
+
+func (q *BoolQueryBase) blockMaxScore(target int32) (float64, int32) {
+	total := float64(0)
+	upto := NO_MORE
+	for _, sub := range q.queries {
+		score, last := sub.blockMaxScore(target)
+		total += score
+		if last < upto {
+			upto = last
+		}
+	}
+	return total, upto
+}
+
+func (q *BoolQueryBase) cloneQueries() []Query {
+	queries := make([]Query, len(q.queries))
+	for i, sub := range q.queries {
+		queries[i] = sub.Clone()
+	}
+	return queries
+}
+
 func (q *BoolQueryBase) AddSubQuery(sub Query) {
 	q.queries = append(q.queries, sub)
 }
 
+func (q *BoolQueryBase) join(sep string) string {
+	s := make([]string, len(q.queries))
+	for i, sub := range q.queries {
+		s[i] = fmt.Sprintf("%s", sub)
+	}
+	return "(" + strings.Join(s, sep) + ")"
+}
+
+// with a min score only the essential queries are iterated (maxscore):
+// the queries with the lowest max scores that together cannot make a
+// document competitive are only advanced to the documents the others
+// match, to score them
 type BoolOrQuery struct {
+	essential []Query
+	minScore  float64
+	skipping  bool
 	BoolQueryBase
 	QueryBase
 }
@@ -146,6 +274,46 @@ func NewBoolOrQuery(queries []Query) *BoolOrQuery {
 	}
 }
 
+func (q *BoolOrQuery) Clone() Query {
+	return NewBoolOrQuery(q.cloneQueries())
+}
+
+func (q *BoolOrQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.BoolQueryBase.Prepare(s)
+	q.essential = q.queries
+	q.minScore = math.Inf(-1)
+	q.skipping = false
+}
+
+// the documents that only match the queries left out of essential are
+// skipped, unless those match nothing in the segment
+func (q *BoolOrQuery) setMinScore(min float64) bool {
+	if min <= q.minScore {
+		return q.skipping
+	}
+	q.minScore = min
+	byMax := append([]Query{}, q.queries...)
+	sort.Slice(byMax, func(i, j int) bool { return byMax[i].maxScore() < byMax[j].maxScore() })
+	total := float64(0)
+	i := 0
+	for ; i < len(byMax); i++ {
+		total += byMax[i].maxScore()
+		if competitive(total, min) {
+			break
+		}
+	}
+	q.essential = byMax[i:]
+	for _, sub := range byMax[:i] {
+		q.skipping = q.skipping || sub.maxScore() > 0
+	}
+	return q.skipping
+}
+
+func (q *BoolOrQuery) String() string {
+	return q.join(" OR ")
+}
+
 func (q *BoolOrQuery) Cost() uint32 {
 	sum := uint32(0)
 	for i := 0; i < len(q.queries); i++ {
@@ -154,9 +322,13 @@ func (q *BoolOrQuery) Cost() uint32 {
 	return sum
 }
 
-func (q *BoolOrQuery) Score() int64 {
-	total := int64(0)
+func (q *BoolOrQuery) Score() float64 {
+	total := float64(0)
 	for i := 0; i < len(q.queries); i++ {
+		// not essential, still before the document
+		if q.queries[i].GetDocId() < q.GetDocId() {
+			q.queries[i].advance(q.GetDocId())
+		}
 		if q.queries[i].GetDocId() == q.GetDocId() {
 			total += q.queries[i].Score()
 		}
@@ -166,7 +338,7 @@ func (q *BoolOrQuery) Score() int64 {
 
 func (q *BoolOrQuery) advance(target int32) int32 {
 	new_doc := NO_MORE
-	for _, sub_query := range q.queries {
+	for _, sub_query := range q.essential {
 		cur_doc := sub_query.GetDocId()
 		if cur_doc < target {
 			cur_doc = sub_query.advance(target)
@@ -181,6 +353,12 @@ func (q *BoolOrQuery) advance(target int32) int32 {
 }
 
 func (q *BoolOrQuery) Next() int32 {
+	if len(q.essential) < len(q.queries) {
+		if q.docId == NO_MORE {
+			return NO_MORE
+		}
+		return q.advance(q.docId + 1)
+	}
 	new_doc := NO_MORE
 	for _, sub_query := range q.queries {
 		cur_doc := sub_query.GetDocId()
@@ -208,6 +386,24 @@ func NewBoolAndQuery(queries []Query) *BoolAndQuery {
 	}
 }
 
+func (q *BoolAndQuery) Clone() Query {
+	return NewBoolAndQuery(q.cloneQueries())
+}
+
+func (q *BoolAndQuery) setMinScore(min float64) bool {
+	// noop, the blocks are skipped with blockMaxScore
+	return false
+}
+
+func (q *BoolAndQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.BoolQueryBase.Prepare(s)
+}
+
+func (q *BoolAndQuery) String() string {
+	return q.join(" AND ")
+}
+
 func (q *BoolAndQuery) Cost() uint32 {
 	if len(q.queries) == 0 {
 		return uint32(0)
@@ -223,8 +419,8 @@ func (q *BoolAndQuery) Cost() uint32 {
 	return min
 }
 
-func (q *BoolAndQuery) Score() int64 {
-	total := int64(0)
+func (q *BoolAndQuery) Score() float64 {
+	total := float64(0)
 	for i := 0; i < len(q.queries); i++ {
 		total += q.queries[i].Score()
 	}
@@ -268,3 +464,211 @@ func (q *BoolAndQuery) Next() int32 {
 
 	return q.nextAndedDoc(q.queries[0].Next())
 }
+
+// matches the documents of the must query, except those matched by any
+// of the mustNot queries
+type BoolNotQuery struct {
+	must    Query
+	mustNot []Query
+	QueryBase
+}
+
+func NewBoolNotQuery(must Query, mustNot []Query) *BoolNotQuery {
+	return &BoolNotQuery{
+		must:      must,
+		mustNot:   mustNot,
+		QueryBase: QueryBase{NOT_READY},
+	}
+}
+
+func (q *BoolNotQuery) AddSubQuery(sub Query) {
+	q.mustNot = append(q.mustNot, sub)
+}
+
+func (q *BoolNotQuery) String() string {
+	s := fmt.Sprintf("(%s", q.must)
+	for _, sub := range q.mustNot {
+		s += fmt.Sprintf(" -%s", sub)
+	}
+	return s + ")"
+}
+
+func (q *BoolNotQuery) Clone() Query {
+	mustNot := make([]Query, len(q.mustNot))
+	for i, sub := range q.mustNot {
+		mustNot[i] = sub.Clone()
+	}
+	return NewBoolNotQuery(q.must.Clone(), mustNot)
+}
+
+func (q *BoolNotQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.must.Prepare(s)
+	for i := 0; i < len(q.mustNot); i++ {
+		q.mustNot[i].Prepare(s)
+	}
+}
+
+func (q *BoolNotQuery) maxScore() float64 {
+	return q.must.maxScore()
+}
+
+func (q *BoolNotQuery) blockMaxScore(target int32) (float64, int32) {
+	return q.must.blockMaxScore(target)
+}
+
+func (q *BoolNotQuery) setMinScore(min float64) bool {
+	return q.must.setMinScore(min)
+}
+
+func (q *BoolNotQuery) Cost() uint32 {
+	return q.must.Cost()
+}
+
+func (q *BoolNotQuery) Score() float64 {
+	return q.must.Score()
+}
+
+func (q *BoolNotQuery) excluded(target int32) bool {
+	for _, sub_query := range q.mustNot {
+		cur_doc := sub_query.GetDocId()
+		if cur_doc < target {
+			cur_doc = sub_query.advance(target)
+		}
+		if cur_doc == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *BoolNotQuery) skipExcluded(target int32) int32 {
+	for target != NO_MORE && q.excluded(target) {
+		target = q.must.Next()
+	}
+	q.docId = target
+	return q.docId
+}
+
+func (q *BoolNotQuery) advance(target int32) int32 {
+	return q.skipExcluded(q.must.advance(target))
+}
+
+func (q *BoolNotQuery) Next() int32 {
+	return q.skipExcluded(q.must.Next())
+}
+
+// matches documents where the terms appear next to each other, at the
+// given offsets relative to the start of the phrase. segments without
+// positions can not verify adjacency, there it works like BoolAndQuery
+type PhraseQuery struct {
+	and        *BoolAndQuery
+	terms      []*Term
+	offsets    []uint32
+	positional bool
+	positions  [][]uint32
+	QueryBase
+}
+
+func NewPhraseQuery(terms []*Term, offsets []uint32) *PhraseQuery {
+	queries := make([]Query, len(terms))
+	for i, t := range terms {
+		queries[i] = t
+	}
+	return &PhraseQuery{
+		and:       NewBoolAndQuery(queries),
+		terms:     terms,
+		offsets:   offsets,
+		positions: make([][]uint32, len(terms)),
+		QueryBase: QueryBase{NOT_READY},
+	}
+}
+
+func (q *PhraseQuery) String() string {
+	s := make([]string, len(q.terms))
+	for i, t := range q.terms {
+		s[i] = t.String()
+	}
+	return fmt.Sprintf("%q", strings.Join(s, " "))
+}
+
+func (q *PhraseQuery) AddSubQuery(sub Query) {
+	// noop
+}
+
+func (q *PhraseQuery) Clone() Query {
+	terms := make([]*Term, len(q.terms))
+	for i, t := range q.terms {
+		terms[i] = t.clone()
+	}
+	return NewPhraseQuery(terms, q.offsets)
+}
+
+func (q *PhraseQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.positional = s.positions
+	q.and.Prepare(s)
+}
+
+func (q *PhraseQuery) maxScore() float64 {
+	return q.and.maxScore()
+}
+
+func (q *PhraseQuery) blockMaxScore(target int32) (float64, int32) {
+	return q.and.blockMaxScore(target)
+}
+
+func (q *PhraseQuery) setMinScore(min float64) bool {
+	// noop
+	return false
+}
+
+func (q *PhraseQuery) Cost() uint32 {
+	return q.and.Cost()
+}
+
+func (q *PhraseQuery) Score() float64 {
+	return q.and.Score()
+}
+
+func (q *PhraseQuery) matches() bool {
+	if !q.positional {
+		return true
+	}
+	for i, t := range q.terms {
+		q.positions[i] = t.postings.positions(q.positions[i][:0])
+	}
+	for _, first := range q.positions[0] {
+		if first < q.offsets[0] {
+			continue
+		}
+		start := first - q.offsets[0]
+		found := true
+		for i := 1; i < len(q.terms) && found; i++ {
+			want := start + q.offsets[i]
+			positions := q.positions[i]
+			j := sort.Search(len(positions), func(k int) bool { return positions[k] >= want })
+			found = j < len(positions) && positions[j] == want
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *PhraseQuery) verify(target int32) int32 {
+	for target != NO_MORE && !q.matches() {
+		target = q.and.Next()
+	}
+	q.docId = target
+	return q.docId
+}
+
+func (q *PhraseQuery) advance(target int32) int32 {
+	return q.verify(q.and.advance(target))
+}
+
+func (q *PhraseQuery) Next() int32 {
+	return q.verify(q.and.Next())
+}
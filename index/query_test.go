@@ -0,0 +1,55 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBoolNotQuery(t *testing.T) {
+	m := NewMemorySegment()
+	addDocuments(m, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+		"/src/net/tcp.go": "func ListenTCP(network string) (*TCPListener, error)",
+		"/src/os/file.go": "func Open(name string) (*File, error)",
+	})
+	s := m.Snapshot()
+
+	var tests = []struct {
+		query    string
+		expected string
+	}{
+		{"string -ListenTCP", "[/src/net/udp.go /src/os/file.go]"},
+		{"string -ListenTCP -Open", "[/src/net/udp.go]"},
+		{"string -(ListenTCP OR Open)", "[/src/net/udp.go]"},
+		{"string -error", "[]"},
+		// the files with network but not ListenTCP are excluded
+		{"string -(network -ListenTCP)", "[/src/net/tcp.go /src/os/file.go]"},
+		{"(string -Open) -ListenUDP", "[/src/net/tcp.go]"},
+		{"Open OR (network -ListenUDP)", "[/src/net/tcp.go /src/os/file.go]"},
+	}
+	for _, test := range tests {
+		if actual := fmt.Sprint(search(t, s, test.query)); actual != test.expected {
+			t.Fatalf("%s: expected %s, actual %s", test.query, test.expected, actual)
+		}
+	}
+
+	// advancing skips the excluded documents too
+	q := NewBoolNotQuery(NewTerm("string"), []Query{NewTerm("ListenTCP")})
+	q.Prepare(s)
+	if id := q.advance(0); id != 1 {
+		t.Fatalf("expected 1, actual %d", id)
+	}
+	if id := q.Next(); id != 2 {
+		t.Fatalf("expected 2, actual %d", id)
+	}
+	if id := q.Next(); id != NO_MORE {
+		t.Fatalf("expected NO_MORE, actual %d", id)
+	}
+
+	// nothing to exclude from
+	for _, query := range []string{"-string", "-string -Open", "network (-ListenTCP)", "network OR -ListenTCP"} {
+		if q, err := Parse(query); err == nil {
+			t.Fatalf("%s: expected error, got %s", query, q)
+		}
+	}
+}
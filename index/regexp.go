@@ -0,0 +1,221 @@
+package index
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"regexp/syntax"
+)
+
+// matches every document in the segment
+type allDocsQuery struct {
+	max int32
+	QueryBase
+}
+
+func (q *allDocsQuery) AddSubQuery(sub Query) {
+	// noop
+}
+
+func (q *allDocsQuery) Clone() Query {
+	return &allDocsQuery{QueryBase: QueryBase{NOT_READY}}
+}
+
+func (q *allDocsQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.max = int32(s.forward.count())
+}
+
+func (q *allDocsQuery) maxScore() float64 {
+	return 1
+}
+
+func (q *allDocsQuery) blockMaxScore(target int32) (float64, int32) {
+	return 1, NO_MORE
+}
+
+func (q *allDocsQuery) setMinScore(min float64) bool {
+	// noop
+	return false
+}
+
+func (q *allDocsQuery) Cost() uint32 {
+	return uint32(q.max)
+}
+
+func (q *allDocsQuery) Score() float64 {
+	return 1
+}
+
+func (q *allDocsQuery) advance(target int32) int32 {
+	if target >= q.max {
+		q.docId = NO_MORE
+	} else {
+		q.docId = target
+	}
+	return q.docId
+}
+
+func (q *allDocsQuery) Next() int32 {
+	return q.advance(q.docId + 1)
+}
+
+// finds candidates with the trigrams that every match must contain and
+// then checks the regexp against the content of the candidate files.
+// segments without trigram index check every file
+type RegexpQuery struct {
+	re      *regexp.Regexp
+	filter  Query
+	all     *allDocsQuery
+	current Query
+	segment *Segment
+	matches int
+	ctx     context.Context
+	QueryBase
+}
+
+func NewRegexpQuery(expr string) (*RegexpQuery, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return &RegexpQuery{
+		re:        re,
+		filter:    regexpTrigramQuery(parsed),
+		all:       &allDocsQuery{},
+		QueryBase: QueryBase{NOT_READY},
+	}, nil
+}
+
+func (q *RegexpQuery) String() string {
+	return fmt.Sprintf("/%s/", q.re)
+}
+
+func (q *RegexpQuery) AddSubQuery(sub Query) {
+	// noop
+}
+
+// the compiled regexp is safe for concurrent use and shared
+func (q *RegexpQuery) Clone() Query {
+	var filter Query
+	if q.filter != nil {
+		filter = q.filter.Clone()
+	}
+	return &RegexpQuery{
+		re:        q.re,
+		filter:    filter,
+		all:       &allDocsQuery{},
+		ctx:       q.ctx,
+		QueryBase: QueryBase{NOT_READY},
+	}
+}
+
+func (q *RegexpQuery) Prepare(s *Segment) {
+	q.docId = NOT_READY
+	q.segment = s
+	if q.filter != nil && s.hasTrigrams {
+		q.current = q.filter
+	} else {
+		q.current = q.all
+	}
+	q.current.Prepare(s)
+}
+
+func (q *RegexpQuery) Cost() uint32 {
+	return q.current.Cost()
+}
+
+func (q *RegexpQuery) Score() float64 {
+	return float64(1 + q.matches)
+}
+
+// the number of matches is only known after reading the file
+func (q *RegexpQuery) maxScore() float64 {
+	return math.Inf(1)
+}
+
+func (q *RegexpQuery) blockMaxScore(target int32) (float64, int32) {
+	return math.Inf(1), NO_MORE
+}
+
+func (q *RegexpQuery) setMinScore(min float64) bool {
+	// noop
+	return false
+}
+
+func (q *RegexpQuery) match(id int32) bool {
+	path, ok := q.segment.forward.read(uint32(id))
+	if !ok || len(path) == 0 {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	// each line on its own like the Highlighter, so ^ and $ are the
+	// start and end of a line
+	q.matches = 0
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		q.matches += len(q.re.FindAllIndex(line, -1))
+	}
+	return q.matches > 0
+}
+
+// reading the candidates can take long, so it stops (as if there were
+// no more matches) when the context is done
+func (q *RegexpQuery) verify(target int32) int32 {
+	for target != NO_MORE {
+		if q.ctx != nil && q.ctx.Err() != nil {
+			target = NO_MORE
+			break
+		}
+		if q.match(target) {
+			break
+		}
+		target = q.current.Next()
+	}
+	q.docId = target
+	return q.docId
+}
+
+func (q *RegexpQuery) advance(target int32) int32 {
+	return q.verify(q.current.advance(target))
+}
+
+func (q *RegexpQuery) Next() int32 {
+	return q.verify(q.current.Next())
+}
+
+// sets ctx on the regexp queries in the query tree
+func setContext(query Query, ctx context.Context) {
+	switch q := query.(type) {
+	case *RegexpQuery:
+		q.ctx = ctx
+	case *BoolAndQuery:
+		for _, sub := range q.queries {
+			setContext(sub, ctx)
+		}
+	case *BoolOrQuery:
+		for _, sub := range q.queries {
+			setContext(sub, ctx)
+		}
+	case *BoolNotQuery:
+		setContext(q.must, ctx)
+		for _, sub := range q.mustNot {
+			setContext(sub, ctx)
+		}
+	}
+}
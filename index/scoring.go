@@ -0,0 +1,66 @@
+package index
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// okapi bm25, the idf and the average document length are per segment
+	SCORING_BM25 = iota
+	// 1 + the weighted term frequency, what zearch used before bm25
+	SCORING_COUNT
+)
+
+const (
+	BM25_K1 = 1.2
+	BM25_B  = 0.75
+)
+
+var SCORINGS = map[string]int{
+	"bm25":  SCORING_BM25,
+	"count": SCORING_COUNT,
+}
+
+// scoring of new terms
+var DEFAULT_SCORING = SCORING_BM25
+
+func ParseScoring(name string) (int, error) {
+	if scoring, ok := SCORINGS[name]; ok {
+		return scoring, nil
+	}
+	return 0, fmt.Errorf("unknown scoring %#v, use bm25 or count", name)
+}
+
+// changes the scoring of all terms in the query tree
+func SetScoring(query Query, scoring int) {
+	switch q := query.(type) {
+	case *Term:
+		q.scoring = scoring
+	case *PhraseQuery:
+		for _, t := range q.terms {
+			t.scoring = scoring
+		}
+	case *WildcardQuery:
+		q.scoring = scoring
+	case *FuzzyQuery:
+		q.scoring = scoring
+	case *BoolAndQuery:
+		for _, sub := range q.queries {
+			SetScoring(sub, scoring)
+		}
+	case *BoolOrQuery:
+		for _, sub := range q.queries {
+			SetScoring(sub, scoring)
+		}
+	case *BoolNotQuery:
+		SetScoring(q.must, scoring)
+	}
+}
+
+// bounds and scores add up the same floats in a different order, so a
+// bound a bit below min could still be a score equal to min, which can
+// make it into the top hits (on the path)
+func competitive(bound float64, min float64) bool {
+	return bound >= min-1e-9*math.Abs(min)
+}
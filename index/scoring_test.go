@@ -0,0 +1,86 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestBM25(t *testing.T) {
+	src := t.TempDir()
+	write := func(name string, data string) {
+		if err := ioutil.WriteFile(path.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1, SegmentsAtATime: 1})
+	// two segments with the same documents, so the same idf and average
+	// length
+	for i := 0; i < 2; i++ {
+		write(fmt.Sprintf("r%d.go", i), "func Rare()")
+		for j := 0; j < 3; j++ {
+			write(fmt.Sprintf("c%d%d.go", i, j), "func Common()")
+		}
+		write(fmt.Sprintf("s%d.go", i), "func Needle()")
+		write(fmt.Sprintf("l%d.go", i), "func Needle(first second third fourth fifth sixth)")
+		update := indexer.Update
+		if i == 0 {
+			update = indexer.Index
+		}
+		if err := update([]string{src}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+	if len(searcher.index.segments) != 2 {
+		t.Fatalf("expected 2 segments, actual %d", len(searcher.index.segments))
+	}
+
+	// the hits in score order, a hit with the same score as the one
+	// before it is in the same group
+	ranked := func(query string, scoring string) [][]string {
+		res, err := searcher.Search(context.Background(), query, SearchOptions{Scoring: scoring})
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := [][]string{}
+		for i, hit := range res.Hits {
+			if i == 0 || hit.Score != res.Hits[i-1].Score {
+				groups = append(groups, []string{})
+			}
+			g := &groups[len(groups)-1]
+			*g = append(*g, path.Base(hit.Path))
+		}
+		return groups
+	}
+	var tests = []struct {
+		query    string
+		scoring  string
+		expected string
+	}{
+		// the rarer term ranks higher, with the idf of each segment
+		{"Rare OR Common", "bm25", "[[r0.go r1.go] [c00.go c01.go c02.go c10.go c11.go c12.go]]"},
+		// the shorter document ranks higher
+		{"Needle", "bm25", "[[s0.go s1.go] [l0.go l1.go]]"},
+		// count scoring ignores both
+		{"Rare OR Common", "count", "[[c00.go c01.go c02.go c10.go c11.go c12.go r0.go r1.go]]"},
+		{"Needle", "count", "[[l0.go l1.go s0.go s1.go]]"},
+	}
+	for _, test := range tests {
+		groups := ranked(test.query, test.scoring)
+		for _, g := range groups {
+			sort.Strings(g)
+		}
+		if actual := fmt.Sprint(groups); actual != test.expected {
+			t.Fatalf("%s, %s: expected %s, actual %s", test.query, test.scoring, test.expected, actual)
+		}
+	}
+}
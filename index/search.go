@@ -0,0 +1,234 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// how a Searcher searches, the zero value uses the defaults
+type SearchOptions struct {
+	// at most this many hits are returned, 100 if 0
+	Limit int
+	// skip the first Offset hits, or the hits up to the cursor After
+	// (the Next of the previous page)
+	Offset int
+	After  string
+	// score, path or mtime, score if empty
+	Sort string
+	// bm25 or count, DEFAULT_SCORING if empty
+	Scoring string
+	// return the matching lines of each hit with this many lines of
+	// context around them, the files are read from disk
+	Highlight bool
+	Context   int
+	// stop searching after this long and return the hits found so far,
+	// no limit if 0
+	Timeout time.Duration
+	// how many segments are searched at the same time,
+	// SEARCH_PARALLELISM if 0
+	Parallelism int
+	// count every matching document in FilesMatching, instead of
+	// skipping those that cannot make it into the hits
+	ExactCount bool
+}
+
+type Hit struct {
+	Path    string
+	Id      int32
+	Segment int
+	Score   float64
+	Mtime   int64
+	Lines   []Line `json:",omitempty"`
+}
+
+type SearchResult struct {
+	// the best hits, in the order of the sort
+	Hits []*Hit
+	// the After of the next page, empty if there are no more hits
+	Next string
+	// all the documents that matched, or a lower bound if
+	// FilesMatchingApproximate
+	FilesMatching            int
+	FilesMatchingApproximate bool
+	FilesInIndex             int
+	TokensInIndex            int
+	Took                     time.Duration
+	// the search was stopped by the timeout or ctx before it looked at
+	// every document, or before every hit was highlighted
+	Partial bool
+}
+
+// searches the index in a directory, safe for concurrent use
+type Searcher struct {
+	index     *Index
+	lock      sync.RWMutex
+	tokenizer func(input string, cb func(text string, weird int))
+}
+
+// a Searcher for an index written with the default Tokenizer, see
+// Indexer.NewSearcher
+func NewSearcher(name string) (*Searcher, error) {
+	index, err := NewIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Searcher{index: index, tokenizer: Tokenize}, nil
+}
+
+// a Searcher for the index x writes, which splits the words of the
+// queries with the Tokenizer of the options of x
+func (x *Indexer) NewSearcher() (*Searcher, error) {
+	s, err := NewSearcher(x.name)
+	if err != nil {
+		return nil, err
+	}
+	s.tokenizer = x.options.Tokenizer
+	return s, nil
+}
+
+// parses query (see Parse) and returns the best hits. returns an error
+// if the query, the scoring, the sort or the cursor cannot be parsed, or
+// ctx is done before the search starts. if ctx is done or the timeout
+// passes while searching the hits found so far are returned as a
+// Partial result
+func (s *Searcher) Search(ctx context.Context, query string, options SearchOptions) (*SearchResult, error) {
+	t0 := time.Now()
+	limit := options.Limit
+	if limit == 0 {
+		limit = 100
+	}
+	sort := SORT_SCORE
+	if options.Sort != "" {
+		var err error
+		if sort, err = ParseSort(options.Sort); err != nil {
+			return nil, err
+		}
+	}
+	top, err := NewTopCollector(limit, options.Offset, sort, options.After)
+	if err != nil {
+		return nil, err
+	}
+	top.ExactTotal = options.ExactCount
+	q, err := parseWithScoring(query, options.Scoring, s.tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel, err := withTimeout(ctx, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+
+	var partial bool
+	var hits []*Hit
+	var next string
+	var files, tokens int
+	func() {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		partial = s.index.Collect(ctx, q, top, options.Parallelism) != nil
+		hits, next = top.Hits(), top.Next()
+		files, tokens = s.index.Stats()
+	}()
+
+	highlighter := NewHighlighterWithTokenizer(q, s.tokenizer)
+	if options.Highlight && !highlighter.Empty() && !partial {
+		for _, hit := range hits {
+			if ctx.Err() != nil {
+				partial = true
+				break
+			}
+			if data, err := ioutil.ReadFile(hit.Path); err == nil {
+				hit.Lines = highlighter.Lines(data, options.Context, MAX_LINES_PER_HIT)
+			}
+		}
+	}
+
+	return &SearchResult{
+		Hits:                     hits,
+		Next:                     next,
+		FilesMatching:            top.Total,
+		FilesMatchingApproximate: !top.Exact(),
+		FilesInIndex:             files,
+		TokensInIndex:            tokens,
+		Took:                     time.Since(t0),
+		Partial:                  partial,
+	}, nil
+}
+
+// passes the documents matching query to c, e.g. a CountCollector to
+// only count them. uses the Scoring, Timeout and Parallelism of options.
+// returns ctx.Err() if ctx is done or the timeout passes, c has the
+// documents found so far then
+func (s *Searcher) Collect(ctx context.Context, query string, c Collector, options SearchOptions) error {
+	q, err := parseWithScoring(query, options.Scoring, s.tokenizer)
+	if err != nil {
+		return err
+	}
+	ctx, cancel, err := withTimeout(ctx, options.Timeout)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.index.Collect(ctx, q, c, options.Parallelism)
+}
+
+func parseWithScoring(query string, scoring string, tokenizer func(input string, cb func(text string, weird int))) (Query, error) {
+	q, err := ParseWithTokenizer(query, tokenizer)
+	if err != nil {
+		return nil, err
+	}
+	if scoring != "" {
+		n, err := ParseScoring(scoring)
+		if err != nil {
+			return nil, err
+		}
+		SetScoring(q, n)
+	}
+	return q, nil
+}
+
+// ctx with the timeout if it is not 0, or ctx.Err() if it is done
+// already
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return ctx, cancel, nil
+	}
+	return ctx, func() {}, nil
+}
+
+// the path of document id in segment, as in Hit
+func (s *Searcher) Fetch(id int32, segment int) (string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.index.FetchForward(int(id), segment)
+}
+
+// picks up the segments written by Indexers since the Searcher was
+// created, see Index.Reload
+func (s *Searcher) Reload() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.index.Reload()
+}
+
+// indexes the changes to the files under args as they happen, see Watch.
+// blocks until watching fails or ctx is done
+func (s *Searcher) Watch(ctx context.Context, indexer *Indexer, args []string, mergeEvery time.Duration) error {
+	return Watch(ctx, s.index, &s.lock, indexer, args, mergeEvery)
+}
+
+func (s *Searcher) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index.Close()
+}
@@ -0,0 +1,399 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIndexerSearcher(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"udp.go":   "func ListenUDP(network string) (*UDPConn, error)",
+		"tcp.go":   "func ListenTCP(network string) (*TCPListener, error)",
+		"notes.md": "ListenUDP is documented here",
+		"tcp.txt":  "ListenTCP",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(path.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go", "md"}, Workers: 1})
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"ListenUDP", []string{"notes.md", "udp.go"}},
+		{"ListenTCP", []string{"tcp.go"}},
+		{"network ext:go", []string{"tcp.go", "udp.go"}},
+	}
+	for _, test := range tests {
+		res, err := searcher.Search(context.Background(), test.query, SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, hit := range res.Hits {
+			found[path.Base(hit.Path)] = true
+		}
+		if res.FilesMatching != len(test.expected) || len(found) != len(test.expected) {
+			t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, found)
+		}
+		for _, f := range test.expected {
+			if !found[f] {
+				t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, found)
+			}
+		}
+	}
+
+	if err := os.Remove(path.Join(src, "udp.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexer.Update([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	if err := searcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := searcher.Search(context.Background(), "ListenUDP", SearchOptions{Limit: 1, Highlight: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Hits) != 1 || path.Base(res.Hits[0].Path) != "notes.md" || len(res.Hits[0].Lines) != 1 {
+		t.Fatalf("unexpected hits %v", res.Hits)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := searcher.Search(ctx, "ListenUDP", SearchOptions{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, actual %v", err)
+	}
+	if _, err := searcher.Search(context.Background(), "ListenUDP", SearchOptions{Scoring: "nope"}); err == nil {
+		t.Fatalf("expected an error for an unknown scoring")
+	}
+	for _, options := range []SearchOptions{{Offset: -1}, {Limit: -1}} {
+		if _, err := searcher.Search(context.Background(), "ListenUDP", options); err == nil {
+			t.Fatalf("%+v: expected an error for a negative offset or limit", options)
+		}
+	}
+	// the searches released the lock
+	if err := searcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdateArgs(t *testing.T) {
+	src := t.TempDir()
+	for _, f := range []string{"a.go", "b.go"} {
+		if err := ioutil.WriteFile(path.Join(src, f), []byte("func ListenUDP()"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1})
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(src, "b.go")); err != nil {
+		t.Fatal(err)
+	}
+	// the same directory as src, but not cleaned
+	arg := src + "/../" + path.Base(src) + "/./"
+	if err := indexer.Update([]string{arg}); err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+	res, err := searcher.Search(context.Background(), "ListenUDP", SearchOptions{ExactCount: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FilesMatching != 1 || path.Base(res.Hits[0].Path) != "a.go" {
+		t.Fatalf("expected a.go, actual %v", res.Hits)
+	}
+}
+
+func TestIndexerOptions(t *testing.T) {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(src, "udp.go"), []byte("func ListenUDP(network string)"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	name := t.TempDir()
+	lower := func(input string, cb func(text string, weird int)) {
+		Tokenize(strings.ToLower(input), cb)
+	}
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1, Tokenizer: lower})
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := indexer.NewSearcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+
+	// the zero options store positions and trigrams
+	for _, s := range searcher.index.segments {
+		if !s.positions || !s.hasTrigrams {
+			t.Fatalf("expected positions and trigrams in %s", s.root)
+		}
+	}
+	for _, query := range []string{"ListenUDP", "LISTENUDP", `"listenudp NETWORK"`, "file:UDP", "Listen*", "LISTEN*dp network.str*"} {
+		res, err := searcher.Search(context.Background(), query, SearchOptions{Highlight: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.FilesMatching != 1 {
+			t.Fatalf("%s: expected udp.go, actual %v", query, res.Hits)
+		}
+		// the content matches are highlighted
+		if lines := res.Hits[0].Lines; !strings.HasPrefix(query, "file:") && (len(lines) != 1 || len(lines[0].Matches) == 0) {
+			t.Fatalf("%s: expected a highlighted line, actual %v", query, lines)
+		}
+	}
+	// the tokenizer cannot split the parts of a wildcard
+	split := func(input string, cb func(text string, weird int)) {
+		for _, text := range strings.Split(input, "x") {
+			cb(text, 0)
+		}
+	}
+	if q, err := ParseWithTokenizer("Lixten*", split); err == nil {
+		t.Fatalf("expected an error, got %s", q)
+	}
+
+	// the default tokenizer does not find the lowercased terms
+	other, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	res, err := other.Search(context.Background(), "ListenUDP", SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.FilesMatching != 0 {
+		t.Fatalf("expected no hits, actual %v", res.Hits)
+	}
+}
+
+func TestExecuteQueryCancel(t *testing.T) {
+	src := t.TempDir()
+	s := NewMemorySegment()
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	data := []byte("func Listen()")
+	for i := 0; i < 3*CHECK_CONTEXT_EVERY; i++ {
+		p := path.Join(src, fmt.Sprintf("%d.go", i))
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		terms.add(indexable{p, src, docInfo{}, s}, data)
+	}
+	index := &Index{segments: []*Segment{s.Snapshot()}}
+
+	for _, query := range []string{"Listen", "/Lis+ten/"} {
+		q, err := Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		n := 0
+		err = index.ExecuteQuery(ctx, q, func(id int32, segment int, score float64) {
+			if n++; n == 10 {
+				cancel()
+			}
+		})
+		if err != context.Canceled || n >= 3*CHECK_CONTEXT_EVERY {
+			t.Fatalf("%s: expected to stop after cancel, actual %v after %d documents", query, err, n)
+		}
+	}
+}
+
+func TestCollectParallel(t *testing.T) {
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	index := &Index{}
+	for i := 0; i < 8; i++ {
+		s := NewMemorySegment()
+		for j := 0; j < 50; j++ {
+			data := strings.Repeat("Listen ", 1+(i*j)%7) + strings.Repeat("Dial ", j%3)
+			terms.add(indexable{fmt.Sprintf("/src/%d/%d.go", i, j), "/src", docInfo{mtime: int64(j)}, s}, []byte(data))
+		}
+		index.segments = append(index.segments, s.Snapshot())
+	}
+
+	collect := func(query string, c Collector, parallelism int) {
+		q, err := Parse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := index.Collect(context.Background(), q, c, parallelism); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range []string{"Listen", "Listen OR Dial", "Listen -Dial", `"Listen Dial"`} {
+		for _, sort := range []int{SORT_SCORE, SORT_PATH, SORT_MTIME} {
+			expected, _ := NewTopCollector(20, 0, sort, "")
+			expected.ExactTotal = true
+			collect(query, expected, 1)
+			all := &AllCollector{}
+			collect(query, all, 4)
+			if expected.Total != len(all.Hits) {
+				t.Fatalf("%s: top collected %d documents, all %d", query, expected.Total, len(all.Hits))
+			}
+
+			for _, parallelism := range []int{2, 3, 8, 16} {
+				actual, _ := NewTopCollector(20, 0, sort, "")
+				collect(query, actual, parallelism)
+				a, e := actual.Hits(), expected.Hits()
+				if actual.Total > expected.Total || actual.Exact() && actual.Total != expected.Total || len(a) != len(e) {
+					t.Fatalf("%s, parallelism %d: expected %d hits of %d, actual %d of %d", query, parallelism, len(e), expected.Total, len(a), actual.Total)
+				}
+				for i := range a {
+					if a[i].Path != e[i].Path || a[i].Score != e[i].Score {
+						t.Fatalf("%s, parallelism %d: hit %d expected %v, actual %v", query, parallelism, i, e[i], a[i])
+					}
+				}
+			}
+
+			// the hits and the cursor do not read the segments after Collect
+			for _, doc := range expected.heap.docs {
+				if doc.segment != nil || doc.path == "" {
+					t.Fatalf("%s: doc %d still reads its segment", query, doc.Id)
+				}
+			}
+
+			e := expected.Hits()
+			for i := 1; i < len(e); i++ {
+				if sort == SORT_SCORE && e[i].Score > e[i-1].Score ||
+					sort == SORT_PATH && e[i].Path < e[i-1].Path ||
+					sort == SORT_MTIME && e[i].Mtime > e[i-1].Mtime {
+					t.Fatalf("%s: hit %v before %v", query, e[i-1], e[i])
+				}
+			}
+
+			// paging through with offset or after gives the same hits
+			after := ""
+			for page := 0; page*5 < len(e); page++ {
+				offset, _ := NewTopCollector(5, page*5, sort, "")
+				collect(query, offset, 3)
+				cursor, err := NewTopCollector(5, 0, sort, after)
+				if err != nil {
+					t.Fatal(err)
+				}
+				collect(query, cursor, 3)
+				for _, c := range []*TopCollector{offset, cursor} {
+					for i, hit := range c.Hits() {
+						if hit.Path != e[page*5+i].Path {
+							t.Fatalf("%s, page %d: hit %d expected %s, actual %s", query, page, i, e[page*5+i].Path, hit.Path)
+						}
+					}
+				}
+				after = cursor.Next()
+			}
+		}
+	}
+}
+
+func TestCollectPruning(t *testing.T) {
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	index := &Index{}
+	r := rand.New(rand.NewSource(0))
+	words := []string{"Listen", "Dial", "Accept", "Close", "Read", "Write"}
+	for i := 0; i < 3; i++ {
+		s := NewMemorySegment()
+		for j := 0; j < 1000; j++ {
+			var data []string
+			for k := r.Intn(60); k >= 0; k-- {
+				// skewed so that the words and their counts vary
+				data = append(data, words[r.Intn(1+r.Intn(len(words)))])
+			}
+			terms.add(indexable{fmt.Sprintf("/src/%d/%d.go", i, j), "/src", docInfo{}, s}, []byte(strings.Join(data, " ")))
+		}
+		index.segments = append(index.segments, s.Snapshot())
+	}
+
+	pruned := false
+	queries := []string{"Listen", "Close", "Listen OR Dial", "Close OR Read OR Write", "Listen Close", "Close -Listen", "Write OR Read -Listen", `"Listen Dial"`}
+	for _, query := range queries {
+		for _, scoring := range []int{SCORING_BM25, SCORING_COUNT} {
+			for _, page := range [][2]int{{1, 0}, {10, 0}, {10, 20}} {
+				var hits [2][]*Hit
+				var totals [2]int
+				var exacts [2]bool
+				for k, exact := range []bool{true, false} {
+					q, err := Parse(query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					SetScoring(q, scoring)
+					c, _ := NewTopCollector(page[0], page[1], SORT_SCORE, "")
+					c.ExactTotal = exact
+					if err := index.Collect(context.Background(), q, c, 1+k*3); err != nil {
+						t.Fatal(err)
+					}
+					if exact && !c.Exact() {
+						t.Fatalf("%s: skipped documents with ExactTotal", query)
+					}
+					hits[k], totals[k], exacts[k] = c.Hits(), c.Total, c.Exact()
+				}
+				if totals[1] < totals[0] && exacts[1] {
+					t.Fatalf("%s, scoring %d, page %v: skipped %d documents, but the total is exact", query, scoring, page, totals[0]-totals[1])
+				}
+				// a single term skips blocks and segments with matching
+				// documents only
+				if !strings.Contains(query, " ") && totals[1] == totals[0] && !exacts[1] {
+					t.Fatalf("%s, scoring %d, page %v: skipped nothing, but the total is approximate", query, scoring, page)
+				}
+				if totals[1] > totals[0] || len(hits[0]) != len(hits[1]) {
+					t.Fatalf("%s, scoring %d, page %v: expected %d hits of %d, actual %d of %d", query, scoring, page, len(hits[0]), totals[0], len(hits[1]), totals[1])
+				}
+				for i := range hits[0] {
+					if hits[0][i].Path != hits[1][i].Path || hits[0][i].Score != hits[1][i].Score {
+						t.Fatalf("%s, scoring %d, page %v: hit %d expected %v, actual %v", query, scoring, page, i, hits[0][i], hits[1][i])
+					}
+				}
+				pruned = pruned || totals[1] < totals[0]
+			}
+		}
+	}
+	if !pruned {
+		t.Fatalf("expected some documents to be skipped")
+	}
+
+	// the documents score the same, so none is skipped once the heap is
+	// full
+	s := NewMemorySegment()
+	for j := 0; j < 100; j++ {
+		terms.add(indexable{fmt.Sprintf("/src/%d.go", j), "/src", docInfo{}, s}, []byte("Listen"))
+	}
+	index = &Index{segments: []*Segment{s.Snapshot()}}
+	c, _ := NewTopCollector(1, 0, SORT_SCORE, "")
+	if err := index.Collect(context.Background(), NewTerm("Listen"), c, 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.Total != 100 || !c.Exact() {
+		t.Fatalf("expected an exact total of 100, actual %d, exact %v", c.Total, c.Exact())
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	mmap "github.com/edsrzf/mmap-go"
+	"hash"
+	"hash/crc32"
 	"os"
 	"path"
 	"sort"
@@ -11,34 +13,101 @@ import (
 	"unsafe"
 )
 
+// m is the content of the file, without header and footer. the first
+// write error is kept in err, the writes after it do nothing
 type MMaped struct {
-	fd *os.File
-	m  mmap.MMap
+	fd     *os.File
+	mapped mmap.MMap
+	m      []byte
+	crc    hash.Hash32
+	err    error
 }
 
-func NewMMaped(name string) *MMaped {
+// an empty file is a new file, anything else has to be a valid segment
+// file (see format.go)
+func NewMMaped(name string) (*MMaped, error) {
+	fd, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
 	p := &MMaped{
-		fd: openOrPanic(name),
+		fd:  fd,
+		crc: crc32.NewIEEE(),
 	}
-	var err error
-	p.m, err = mmap.MapRegion(p.fd, -1, mmap.RDONLY, 0, 0)
+	if info, err := fd.Stat(); err != nil || info.Size() == 0 {
+		return p, err
+	}
+	p.mapped, err = mmap.MapRegion(p.fd, -1, mmap.RDONLY, 0, 0)
 	if err != nil {
-		p.m = mmap.MMap{}
+		p.close()
+		return nil, fmt.Errorf("%s: %s", name, err)
 	}
-	return p
+	p.m, err = unframe(name, p.mapped)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// an MMaped without file lives in memory, writes are appended to m
+func newMemoryMMaped() *MMaped {
+	return &MMaped{}
 }
 
 func (m *MMaped) close() {
-	m.m.Unmap()
+	if m == nil || m.fd == nil {
+		return
+	}
+	if m.mapped != nil {
+		m.mapped.Unmap()
+	}
 	m.fd.Close()
 }
 
+// starts writing the file from scratch, with the header. in memory
+// there is no header and the old content is left alone, it can still be
+// in use by a reader
 func (m *MMaped) seekToStart() {
-	m.fd.Seek(0, 0)
+	if m.fd == nil {
+		m.m = nil
+		return
+	}
+	m.err = nil
+	if _, err := m.fd.Seek(0, 0); err != nil {
+		m.err = err
+	} else if err := m.fd.Truncate(0); err != nil {
+		m.err = err
+	}
+	m.crc.Reset()
+	m.write(fileHeader())
 }
 
-func (m *MMaped) writeOrPanic(b []byte) {
-	writeOrPanic(m.fd, b)
+func (m *MMaped) write(b []byte) {
+	if m.fd == nil {
+		m.m = append(m.m, b...)
+		return
+	}
+	if m.err != nil {
+		return
+	}
+	m.crc.Write(b)
+	_, m.err = m.fd.Write(b)
+}
+
+// writes the footer, after the content, and returns the first error
+// of the writes
+func (m *MMaped) finish() error {
+	if m.fd == nil {
+		return nil
+	}
+	if m.err == nil {
+		_, m.err = m.fd.Write(fileFooter(m.crc.Sum32()))
+	}
+	if m.err != nil {
+		return fmt.Errorf("%s: %s", m.fd.Name(), m.err)
+	}
+	return nil
 }
 
 type StoredStringArray struct {
@@ -46,21 +115,35 @@ type StoredStringArray struct {
 	header *MMaped
 }
 
-func NewStoredStringArray(name string) *StoredStringArray {
-	s := &StoredStringArray{
-		data:   NewMMaped(fmt.Sprintf("%s.data", name)),
-		header: NewMMaped(fmt.Sprintf("%s.header", name)),
+func NewStoredStringArray(name string) (*StoredStringArray, error) {
+	data, err := NewMMaped(fmt.Sprintf("%s.data", name))
+	if err != nil {
+		return nil, err
+	}
+	header, err := NewMMaped(fmt.Sprintf("%s.header", name))
+	if err != nil {
+		data.close()
+		return nil, err
 	}
+	return &StoredStringArray{data: data, header: header}, nil
+}
 
-	return s
+func newMemoryStoredStringArray() *StoredStringArray {
+	return &StoredStringArray{
+		data:   newMemoryMMaped(),
+		header: newMemoryMMaped(),
+	}
 }
 
 func (s *StoredStringArray) close() {
+	if s == nil {
+		return
+	}
 	s.data.close()
 	s.header.close()
 }
 
-func (s *StoredStringArray) write(input []string, cb func(string) uint64) {
+func (s *StoredStringArray) write(input []string, cb func(string) uint64) error {
 	b8 := make([]byte, 8)
 	off := uint32(0)
 	s.header.seekToStart()
@@ -69,15 +152,19 @@ func (s *StoredStringArray) write(input []string, cb func(string) uint64) {
 	for i := 0; i < len(input); i++ {
 		bstr := []byte(input[i])
 		putUint64(b8, uint64(off)<<32|uint64(len(bstr)))
-		s.header.writeOrPanic(b8)
+		s.header.write(b8)
 
 		extra := cb(input[i])
 		putUint64(b8, extra)
-		s.header.writeOrPanic(b8)
+		s.header.write(b8)
 
-		s.data.writeOrPanic(bstr)
+		s.data.write(bstr)
 		off += uint32(len(bstr))
 	}
+	if err := s.header.finish(); err != nil {
+		return err
+	}
+	return s.data.finish()
 }
 
 func (s *StoredStringArray) count() int {
@@ -90,7 +177,7 @@ func (s *StoredStringArray) bcmp(offa, lena uint32, b []byte) int {
 
 func (s *StoredStringArray) read(id uint32) (string, bool) {
 	size := s.count()
-	if id > uint32(size) {
+	if id >= uint32(size) {
 		return "", false
 	}
 	offlen := getUint64(s.header.m, uint32(id*16))
@@ -100,7 +187,20 @@ func (s *StoredStringArray) read(id uint32) (string, bool) {
 	return string(s.data.m[off : off+len]), true
 }
 
-func (s *StoredStringArray) bsearch(input []byte) (uint64, bool) {
+func (s *StoredStringArray) extra(id uint32) uint64 {
+	return getUint64(s.header.m, id*16+8)
+}
+
+// string id without copying it, only valid until the array is closed
+func (s *StoredStringArray) bytes(id int) []byte {
+	offlen := getUint64(s.header.m, uint32(id*16))
+	off := uint32(offlen >> 32)
+	return s.data.m[off : off+uint32(offlen&0xFFFFFFFF)]
+}
+
+// the id of the first string >= input in a sorted array, count() if
+// there is none
+func (s *StoredStringArray) search(input []byte) int {
 	start := 0
 	end := s.count()
 	for start < end {
@@ -109,62 +209,273 @@ func (s *StoredStringArray) bsearch(input []byte) (uint64, bool) {
 
 		offa := uint32(offlen >> 32)
 		lena := uint32(offlen & 0xFFFFFFFF)
-		diff := s.bcmp(offa, lena, input)
-
-		if diff == 0 {
-			extra := getUint64(s.header.m, uint32(mid*16)+8)
-			return extra, true
-		}
-		if diff < 0 {
+		if s.bcmp(offa, lena, input) < 0 {
 			start = mid + 1
 		} else {
 			end = mid
 		}
 	}
+	return start
+}
+
+func (s *StoredStringArray) bsearch(input []byte) (uint64, bool) {
+	id := s.search(input)
+	if id < s.count() && bytes.Equal(s.bytes(id), input) {
+		return s.extra(uint32(id)), true
+	}
 	return 0, false
 }
 
+// bump whenever the layout of any of the segment files changes
+const FORMAT_VERSION = 8
+
+const (
+	FLAG_POSITIONS = 1 << iota
+	FLAG_TRIGRAMS
+)
+
 type Segment struct {
-	inmemoryInverted map[string][]int32
+	inmemoryInverted map[string][]posting
+	inmemoryTrigrams map[string][]posting
 	inmemoryForward  []string
+	inmemoryLengths  []uint32
+	inmemoryInfo     []docInfo
 	inverted         *StoredStringArray
 	forward          *StoredStringArray
 	postings         *MMaped
+	trigrams         *StoredStringArray
+	trigramPostings  *MMaped
+	docinfo          *MMaped
+	meta             *MMaped
+	deleted          []uint64
+	root             string
+	positions        bool
+	hasTrigrams      bool
+	avgLength        float64
 	sync.Mutex
 }
 
-func NewSegment(root string) *Segment {
+func NewSegment(root string) (*Segment, error) {
+	s := &Segment{
+		inmemoryInverted: make(map[string][]posting),
+		inmemoryTrigrams: make(map[string][]posting),
+		inmemoryForward:  make([]string, 0, 100),
+		root:             root,
+		positions:        STORE_POSITIONS,
+		hasTrigrams:      STORE_TRIGRAMS,
+	}
+	var err error
+	open := func(name string) *MMaped {
+		var m *MMaped
+		if err == nil {
+			m, err = NewMMaped(path.Join(root, name))
+		}
+		return m
+	}
+	openArray := func(name string) *StoredStringArray {
+		var a *StoredStringArray
+		if err == nil {
+			a, err = NewStoredStringArray(path.Join(root, name))
+		}
+		return a
+	}
+	s.inverted = openArray("inverted")
+	s.forward = openArray("forward")
+	s.postings = open("posting")
+	s.trigrams = openArray("trigram")
+	s.trigramPostings = open("trigram.posting")
+	s.docinfo = open("docinfo")
+	s.meta = open("meta")
+	if err == nil {
+		s.deleted, err = readDeleted(path.Join(root, "deleted"))
+	}
+	if err == nil {
+		err = s.readMeta()
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// a segment that is not backed by files, documents added to it are
+// searchable in the segments returned by Snapshot
+func NewMemorySegment() *Segment {
 	return &Segment{
-		inmemoryInverted: make(map[string][]int32),
-		inmemoryForward:  make([]string, 100),
-		inverted:         NewStoredStringArray(path.Join(root,"inverted")),
-		forward:          NewStoredStringArray(path.Join(root,"forward")),
-		postings:         NewMMaped(path.Join(root,"posting")),
+		inmemoryInverted: make(map[string][]posting),
+		inmemoryTrigrams: make(map[string][]posting),
+		inmemoryForward:  make([]string, 0, 100),
+		inverted:         newMemoryStoredStringArray(),
+		forward:          newMemoryStoredStringArray(),
+		postings:         newMemoryMMaped(),
+		trigrams:         newMemoryStoredStringArray(),
+		trigramPostings:  newMemoryMMaped(),
+		docinfo:          newMemoryMMaped(),
+		meta:             newMemoryMMaped(),
+		positions:        STORE_POSITIONS,
+		hasTrigrams:      STORE_TRIGRAMS,
 	}
 }
+
+func (s *Segment) inMemory() bool {
+	return s.root == ""
+}
+
+// the files of the segment by name, except deleted
+func (s *Segment) files() map[string]*MMaped {
+	return map[string]*MMaped{
+		"inverted.header": s.inverted.header,
+		"inverted.data":   s.inverted.data,
+		"posting":         s.postings,
+		"forward.header":  s.forward.header,
+		"forward.data":    s.forward.data,
+		"trigram.header":  s.trigrams.header,
+		"trigram.data":    s.trigrams.data,
+		"trigram.posting": s.trigramPostings,
+		"docinfo":         s.docinfo,
+		"meta":            s.meta,
+	}
+}
+
+func (s *Segment) readMeta() error {
+	if !s.inMemory() {
+		// either all files are written or the segment is new
+		written := 0
+		for _, f := range s.files() {
+			if len(f.mapped) > 0 {
+				written++
+			}
+		}
+		if written > 0 {
+			for name, f := range s.files() {
+				if len(f.mapped) == 0 {
+					return fmt.Errorf("%s: %s is empty, the segment is incomplete, reindex", s.root, name)
+				}
+			}
+		}
+	}
+	if len(s.meta.m) == 0 {
+		return nil
+	}
+	if version := getUint32(s.meta.m, 0); version != FORMAT_VERSION {
+		return fmt.Errorf("%s: unsupported segment format version %d, expected %d, reindex", s.root, version, FORMAT_VERSION)
+	}
+	flags := getUint32(s.meta.m, 4)
+	s.positions = flags&FLAG_POSITIONS != 0
+	s.hasTrigrams = flags&FLAG_TRIGRAMS != 0
+	if docs := s.forward.count(); docs > 0 {
+		s.avgLength = float64(getUint64(s.meta.m, 8)) / float64(docs)
+	}
+	return nil
+}
+
+// s uses the in-memory documents of src, to write them
+func (s *Segment) use(src *Segment) {
+	s.inmemoryInverted = src.inmemoryInverted
+	s.inmemoryTrigrams = src.inmemoryTrigrams
+	s.inmemoryForward = src.inmemoryForward
+	s.inmemoryLengths = src.inmemoryLengths
+	s.inmemoryInfo = src.inmemoryInfo
+	s.positions = src.positions
+	s.hasTrigrams = src.hasTrigrams
+}
+
+// a read only view of the documents added so far to an in-memory segment:
+// the terms are sorted and the postings encoded like flushToDisk does,
+// but into memory. the segment can keep adding documents, they are only
+// visible in the next snapshot. writing to memory does not fail
+func (s *Segment) Snapshot() *Segment {
+	s.Lock()
+	defer s.Unlock()
+
+	v := NewMemorySegment()
+	v.use(s)
+	v.write()
+	v.readMeta()
+	v.deleted = append([]uint64{}, s.deleted...)
+	v.clear()
+	return v
+}
+
+// writes the documents of an in-memory segment into d, a created segment
+func (s *Segment) persist(d *Segment) error {
+	s.Lock()
+	defer s.Unlock()
+
+	defer d.close()
+	d.use(s)
+	d.deleted = s.deleted
+	if err := d.flushToDisk(); err != nil {
+		return err
+	}
+	return d.saveDeleted()
+}
+
+// closes the files that are open, also of a partially opened segment
 func (s *Segment) close() {
 	s.inverted.close()
 	s.forward.close()
 	s.postings.close()
+	s.trigrams.close()
+	s.trigramPostings.close()
+	s.docinfo.close()
+	s.meta.close()
 }
-func (s *Segment) findPostingsList(term string) []byte {
-	extra, ok := s.inverted.bsearch([]byte(term))
+
+// the extra of each term in the dictionary is the offset<<32|length of
+// its postinglist
+func postingsAt(postings *MMaped, extra uint64) []byte {
+	off := uint32(extra >> 32)
+	l := uint32(extra & 0xFFFFFFFF)
+	return postings.m[int(off):int(off+l)]
+}
+
+func findPostings(dictionary *StoredStringArray, postings *MMaped, term string) []byte {
+	extra, ok := dictionary.bsearch([]byte(term))
 	if ok {
-		off := uint32(extra >> 32)
-		l := uint32(extra & 0xFFFFFFFF)
-		return s.postings.m[int(off):int(off+l)]
+		return postingsAt(postings, extra)
 	}
 	return []byte{}
 }
 
-func (s *Segment) addForward(doc string) int32 {
+func (s *Segment) findPostingsList(term string) []byte {
+	return findPostings(s.inverted, s.postings, term)
+}
+
+func (s *Segment) findTrigramPostingsList(trigram string) []byte {
+	return findPostings(s.trigrams, s.trigramPostings, trigram)
+}
+
+// length is the number of content tokens in the document
+func (s *Segment) addForward(doc string, length uint32, info docInfo) int32 {
 	id := len(s.inmemoryForward)
 	s.inmemoryForward = append(s.inmemoryForward, doc)
+	s.inmemoryLengths = append(s.inmemoryLengths, length)
+	s.inmemoryInfo = append(s.inmemoryInfo, info)
 	return int32(id)
 }
 
-func (s *Segment) addInverted(term string, id int32) {
-	s.inmemoryInverted[term] = append(s.inmemoryInverted[term], id)
+func (s *Segment) docInfo(id int32) docInfo {
+	return docInfo{
+		mtime: int64(getUint64(s.docinfo.m, uint32(id)*16)),
+		size:  int64(getUint64(s.docinfo.m, uint32(id)*16+8)),
+	}
+}
+
+func (s *Segment) docLength(id int32) uint32 {
+	return uint32(getUint64(s.forward.header.m, uint32(id)*16+8))
+}
+
+func (s *Segment) addInverted(term string, id int32, tf uint32, positions []uint32) {
+	if !s.positions {
+		positions = nil
+	}
+	s.inmemoryInverted[term] = append(s.inmemoryInverted[term], posting{id, tf, positions})
+}
+
+func (s *Segment) addTrigram(trigram string, id int32) {
+	s.inmemoryTrigrams[trigram] = append(s.inmemoryTrigrams[trigram], posting{id, 1, nil})
 }
 
 func unsafeCompare(a string, b string) int {
@@ -185,36 +496,93 @@ func (s ByBytes) Less(i, j int) bool {
 	return unsafeCompare(s[i], s[j]) < 0
 }
 
-func (s *Segment) flushToDisk() {
-	terms := make([]string, len(s.inmemoryInverted))
+func writeInverted(inmemory map[string][]posting, dictionary *StoredStringArray, postings *MMaped, positional bool, lengths []uint32) error {
+	terms := make([]string, len(inmemory))
 	i := 0
-	for k := range s.inmemoryInverted {
+	for k := range inmemory {
 		terms[i] = k
 		i++
 	}
 	sort.Sort(ByBytes(terms))
 
 	postings_off := int64(0)
-	s.postings.seekToStart()
-	s.inverted.write(terms, func(st string) uint64 {
-		tpostings := s.inmemoryInverted[st]
-		plen := len(tpostings) * 4
-		ret := uint64(postings_off)<<32 | uint64(plen)
-		buf := make([]byte, plen)
-		postings_off += int64(plen)
-
-		soff := 0
-		for _, id := range tpostings {
-			putUint32Off(buf, soff, uint32(id))
-			soff += 4
-		}
-		s.postings.writeOrPanic(buf)
+	postings.seekToStart()
+	err := dictionary.write(terms, func(st string) uint64 {
+		buf := encodePostings(inmemory[st], positional, lengths)
+		ret := uint64(postings_off)<<32 | uint64(len(buf))
+		postings_off += int64(len(buf))
+		postings.write(buf)
 		return ret
 	})
+	if err != nil {
+		return err
+	}
+	return postings.finish()
+}
+
+// the in-memory documents are kept if they cannot be written
+func (s *Segment) flushToDisk() error {
+	if err := s.write(); err != nil {
+		return err
+	}
+	s.clear()
+	return nil
+}
+
+// writes the in-memory documents into the segment files
+func (s *Segment) write() error {
+	// the trigram files are written even when they are not used, so
+	// every file of a segment has a header
+	if err := writeInverted(s.inmemoryInverted, s.inverted, s.postings, s.positions, s.inmemoryLengths); err != nil {
+		return err
+	}
+	if err := writeInverted(s.inmemoryTrigrams, s.trigrams, s.trigramPostings, false, nil); err != nil {
+		return err
+	}
 
-	s.forward.write(s.inmemoryForward, func(st string) uint64 {
-		return uint64(0)
+	i := 0
+	total := uint64(0)
+	err := s.forward.write(s.inmemoryForward, func(st string) uint64 {
+		length := s.inmemoryLengths[i]
+		total += uint64(length)
+		i++
+		return uint64(length)
 	})
+	if err != nil {
+		return err
+	}
+
+	b16 := make([]byte, 16)
+	s.docinfo.seekToStart()
+	for _, info := range s.inmemoryInfo {
+		putUint64(b16, uint64(info.mtime))
+		putUint64(b16[8:], uint64(info.size))
+		s.docinfo.write(b16)
+	}
+	if err := s.docinfo.finish(); err != nil {
+		return err
+	}
+
+	flags := uint32(0)
+	if s.positions {
+		flags |= FLAG_POSITIONS
+	}
+	if s.hasTrigrams {
+		flags |= FLAG_TRIGRAMS
+	}
+	meta := make([]byte, 16)
+	putUint32Off(meta, 0, FORMAT_VERSION)
+	putUint32Off(meta, 4, flags)
+	putUint64(meta[8:], total)
+	s.meta.seekToStart()
+	s.meta.write(meta)
+	return s.meta.finish()
+}
+
+func (s *Segment) clear() {
 	s.inmemoryForward = nil
+	s.inmemoryLengths = nil
+	s.inmemoryInfo = nil
 	s.inmemoryInverted = nil
+	s.inmemoryTrigrams = nil
 }
@@ -0,0 +1,104 @@
+package index
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func addDocuments(s *Segment, docs map[string]string) {
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	// in path order, so that the ids do not depend on the map order
+	paths := []string{}
+	for path := range docs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		terms.add(indexable{path, "/src", docInfo{}, s}, []byte(docs[path]))
+	}
+}
+
+func search(t *testing.T, s *Segment, query string) []string {
+	q, err := Parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := []string{}
+	q.Prepare(s)
+	for q.Next() != NO_MORE {
+		id := q.GetDocId()
+		if s.isDeleted(id) {
+			continue
+		}
+		path, _ := s.forward.read(uint32(id))
+		found = append(found, path)
+	}
+	return found
+}
+
+func TestMemorySegment(t *testing.T) {
+	s := NewMemorySegment()
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+		"/src/net/tcp.go": "func ListenTCP(network string) (*TCPListener, error)",
+	})
+	before := s.Snapshot()
+	addDocuments(s, map[string]string{
+		"/src/os/file.go": "func Open(name string) (*File, error)",
+	})
+	s.delete(0)
+	after := s.Snapshot()
+
+	var tests = []struct {
+		segment  *Segment
+		query    string
+		expected []string
+	}{
+		{before, "network", []string{"/src/net/tcp.go", "/src/net/udp.go"}},
+		{before, `"ListenUDP network"`, []string{"/src/net/udp.go"}},
+		{before, "path:net -ListenTCP", []string{"/src/net/udp.go"}},
+		{before, "Open", []string{}},
+		{after, "string", []string{"/src/net/udp.go", "/src/os/file.go"}},
+		{after, "Open file:file", []string{"/src/os/file.go"}},
+	}
+	for _, test := range tests {
+		actual := search(t, test.segment, test.query)
+		if len(actual) != len(test.expected) {
+			t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, actual)
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, actual)
+			}
+		}
+	}
+	if before.docLength(0) != 6 || before.avgLength != 6 {
+		t.Fatalf("unexpected length %d, avg %f", before.docLength(0), before.avgLength)
+	}
+}
+
+func TestNewSegmentCorrupted(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewSegment(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+	})
+	if err := s.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	if err := os.Truncate(path.Join(root, "forward.data"), 20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSegment(root); err == nil || !strings.Contains(err.Error(), "forward.data") {
+		t.Fatalf("expected an error for forward.data, actual %v", err)
+	}
+}
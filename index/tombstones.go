@@ -0,0 +1,100 @@
+package index
+
+import (
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path"
+)
+
+// what is needed to tell if a file changed since it was indexed
+type docInfo struct {
+	mtime int64
+	size  int64
+}
+
+func newDocInfo(f os.FileInfo) docInfo {
+	return docInfo{mtime: f.ModTime().UnixNano(), size: f.Size()}
+}
+
+// the deleted documents of a segment are kept in a bitmap in the
+// `deleted` file, it is the only file of a segment that changes after
+// the segment is written, so it is read in memory instead of mmaped
+func readDeleted(name string) ([]uint64, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err = unframe(name, data)
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]uint64, len(data)/8)
+	for i := range deleted {
+		deleted[i] = getUint64(data, uint32(i*8))
+	}
+	return deleted, nil
+}
+
+func (s *Segment) isDeleted(id int32) bool {
+	word := int(id >> 6)
+	if word >= len(s.deleted) {
+		return false
+	}
+	return s.deleted[word]&(1<<uint(id&63)) != 0
+}
+
+func (s *Segment) delete(id int32) {
+	word := int(id >> 6)
+	for word >= len(s.deleted) {
+		s.deleted = append(s.deleted, 0)
+	}
+	s.deleted[word] |= 1 << uint(id&63)
+}
+
+// marks the documents of deleted as deleted too
+func (s *Segment) addDeleted(deleted []uint64) {
+	for i, w := range deleted {
+		if i < len(s.deleted) {
+			s.deleted[i] |= w
+		} else {
+			s.deleted = append(s.deleted, w)
+		}
+	}
+}
+
+// adds the documents another writer deleted since s was opened, so that
+// saving s does not bring them back
+func (s *Segment) reloadDeleted() error {
+	deleted, err := readDeleted(path.Join(s.root, "deleted"))
+	if err != nil {
+		return err
+	}
+	s.addDeleted(deleted)
+	return nil
+}
+
+func (s *Segment) deletedCount() int {
+	n := 0
+	for _, w := range s.deleted {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// writes the bitmap to a temporary file and renames it over the old
+// one, so a running server never sees a partially written bitmap.
+// in-memory segments keep it only in memory
+func (s *Segment) saveDeleted() error {
+	if s.inMemory() {
+		return nil
+	}
+	data := make([]byte, len(s.deleted)*8)
+	for i, w := range s.deleted {
+		putUint64(data[i*8:], w)
+	}
+	return writeFileAtomic(path.Join(s.root, "deleted"), frame(data))
+}
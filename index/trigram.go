@@ -0,0 +1,125 @@
+package index
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// calls cb for every distinct 3 byte sequence in data, trigrams spanning
+// multiple lines are skipped because regexps are matched line by line
+func trigrams(data []byte, cb func(string)) {
+	seen := map[string]bool{}
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] == '\n' || data[i+1] == '\n' || data[i+2] == '\n' {
+			continue
+		}
+		if seen[string(data[i:i+3])] {
+			continue
+		}
+		t := string(data[i : i+3])
+		seen[t] = true
+		cb(t)
+	}
+}
+
+// AND of all trigrams in s, nil means that s is too short to filter anything
+func trigramsAnd(s string) Query {
+	queries := []Query{}
+	trigrams([]byte(s), func(t string) {
+		queries = append(queries, NewTrigramTerm(t))
+	})
+	return and(queries)
+}
+
+// what is known about the strings matched by a regexp: either the exact
+// string (exact is true) or a query for the trigrams every match must
+// contain, nil query means that anything can match
+type regexpInfo struct {
+	exact   bool
+	literal string
+	query   Query
+}
+
+func (i regexpInfo) trigramQuery() Query {
+	if i.exact {
+		return trigramsAnd(i.literal)
+	}
+	return i.query
+}
+
+func analyzeConcat(subs []*syntax.Regexp) regexpInfo {
+	queries := []Query{}
+	add := func(q Query) {
+		if a, ok := q.(*BoolAndQuery); ok {
+			queries = append(queries, a.queries...)
+		} else if q != nil {
+			queries = append(queries, q)
+		}
+	}
+	exact := true
+	run := ""
+	flush := func() {
+		add(trigramsAnd(run))
+		run = ""
+	}
+	all := ""
+	for _, sub := range subs {
+		info := analyzeRegexp(sub)
+		if info.exact {
+			run += info.literal
+			all += info.literal
+			continue
+		}
+		exact = false
+		flush()
+		add(info.query)
+	}
+	if exact {
+		return regexpInfo{exact: true, literal: all}
+	}
+	flush()
+	return regexpInfo{query: and(queries)}
+}
+
+func analyzeRegexp(re *syntax.Regexp) regexpInfo {
+	switch re.Op {
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return regexpInfo{exact: true}
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return regexpInfo{}
+		}
+		buf := make([]byte, 0, len(re.Rune))
+		for _, r := range re.Rune {
+			buf = utf8.AppendRune(buf, r)
+		}
+		return regexpInfo{exact: true, literal: string(buf)}
+	case syntax.OpCapture:
+		return analyzeRegexp(re.Sub[0])
+	case syntax.OpPlus:
+		return regexpInfo{query: analyzeRegexp(re.Sub[0]).trigramQuery()}
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return regexpInfo{query: analyzeRegexp(re.Sub[0]).trigramQuery()}
+		}
+	case syntax.OpConcat:
+		return analyzeConcat(re.Sub)
+	case syntax.OpAlternate:
+		queries := []Query{}
+		for _, sub := range re.Sub {
+			q := analyzeRegexp(sub).trigramQuery()
+			if q == nil {
+				return regexpInfo{}
+			}
+			queries = append(queries, q)
+		}
+		return regexpInfo{query: NewBoolOrQuery(queries)}
+	}
+	return regexpInfo{}
+}
+
+// query for the trigrams that every match of re must contain, nil if
+// no trigrams can be derived and every file has to be checked
+func regexpTrigramQuery(re *syntax.Regexp) Query {
+	return analyzeRegexp(re.Simplify()).trigramQuery()
+}
@@ -0,0 +1,76 @@
+package index
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp/syntax"
+	"testing"
+)
+
+var trigramTests = []struct {
+	expr     string
+	expected string
+}{
+	{"abcd", `(trigram:"abc" AND trigram:"bcd")`},
+	{"ab", "<nil>"},
+	{"^func main", `(trigram:"fun" AND trigram:"unc" AND trigram:"nc " AND trigram:"c m" AND trigram:" ma" AND trigram:"mai" AND trigram:"ain")`},
+	{`func\s+main`, `(trigram:"fun" AND trigram:"unc" AND trigram:"mai" AND trigram:"ain")`},
+	{"(abc|def)ghi", `((trigram:"abc" OR trigram:"def") AND trigram:"ghi")`},
+	{"(abc|d)ghi", `trigram:"ghi"`},
+	{"a.*b", "<nil>"},
+	{"(?i)abc", "<nil>"},
+	{"(abc)+", `trigram:"abc"`},
+	{"(abc)*def", `trigram:"def"`},
+}
+
+func TestRegexpTrigrams(t *testing.T) {
+	for _, tt := range trigramTests {
+		re, err := syntax.Parse(tt.expr, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := fmt.Sprintf("%v", regexpTrigramQuery(re)); actual != tt.expected {
+			t.Errorf("%s: expected %s, actual %s", tt.expr, tt.expected, actual)
+		}
+	}
+}
+
+func TestRegexpLines(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"main.go": "package main\nfunc main() {}\n",
+		"doc.go":  "// func main() {} is the entry point\n",
+	}
+	s := NewMemorySegment()
+	options := DefaultIndexerOptions()
+	terms := newDocumentTerms(&options)
+	for _, name := range []string{"main.go", "doc.go"} {
+		p := path.Join(src, name)
+		if err := ioutil.WriteFile(p, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		terms.add(indexable{p, src, docInfo{}, s}, []byte(files[name]))
+	}
+	snapshot := s.Snapshot()
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{`/^func main/`, []string{"main.go"}},
+		{`/main\(\) \{\}$/`, []string{"main.go"}},
+		{`/^package main$/`, []string{"main.go"}},
+		{`/func main/`, []string{"main.go", "doc.go"}},
+		{`/main\s+func/`, []string{}},
+	}
+	for _, test := range tests {
+		actual := []string{}
+		for _, p := range search(t, snapshot, test.query) {
+			actual = append(actual, path.Base(p))
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Errorf("%s: expected %v, actual %v", test.query, test.expected, actual)
+		}
+	}
+}
@@ -14,16 +14,20 @@ var WEIRD = map[string]int{
 }
 
 func Tokenize(input string, cb func(string, int)) {
+	tokenizeWithOffsets(input, func(text string, weird int, offset int) {
+		cb(text, weird)
+	})
+}
+
+// same as Tokenize, but also passes the byte offset of each token
+func tokenizeWithOffsets(input string, cb func(string, int, int)) {
 	weird := 0
 	start, end := -1, -1
 	for i, c := range input {
 		if c == '\n' || c == '\r' {
 			weird = 0
 		}
-		if c >= 'A' && c <= 'Z' {
-			c |= 0x20
-		}
-		if (c >= 'a' && c <= 'z') || c == '_' || c == ':' || (c >= '0' && c <= '9') {
+		if isTokenChar(c) {
 			if start == -1 {
 				start = i
 				end = start
@@ -34,17 +38,25 @@ func Tokenize(input string, cb func(string, int)) {
 				s := input[start:end]
 				if _, ok := WEIRD[s]; ok {
 					weird = 1
-					cb(s, 0)
+					cb(s, 0, start)
 				} else {
-					cb(s, weird)
+					cb(s, weird, start)
 				}
 			}
 			start, end = -1, -1
 		}
 	}
 	if end-start > 0 {
-		cb(input[start:end], weird)
+		cb(input[start:end], weird, start)
+	}
+}
+
+// letters, digits, _ and :
+func isTokenChar(c rune) bool {
+	if c >= 'A' && c <= 'Z' {
+		c |= 0x20
 	}
+	return (c >= 'a' && c <= 'z') || c == '_' || c == ':' || (c >= '0' && c <= '9')
 }
 
 func Took(name string, r func()) {
@@ -88,17 +100,27 @@ func putUint64(b []byte, v uint64) {
 	b[7] = byte(v >> 56)
 }
 
-func openOrPanic(name string) *os.File {
-	fd, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		panic(err)
-	}
-	return fd
+func openFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
 }
 
-func writeOrPanic(fd *os.File, b []byte) {
-	_, err := fd.Write(b)
+// writes b to a new file, synced before it is renamed over name, so
+// name is either the old or the new content even after a crash
+func writeFileAtomic(name string, b []byte) error {
+	fd, err := os.Create(name + ".tmp")
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if _, err := fd.Write(b); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
 	}
+	return os.Rename(name+".tmp", name)
 }
@@ -56,7 +56,7 @@ func TestTokenizer(t *testing.T) {
 	for _, tt := range tokenizerTests {
 		s_actual := []string{}
 		w_actual := []int{}
-		tokenize(tt.input, func(s string, w int) {
+		Tokenize(tt.input, func(s string, w int) {
 			w_actual = append(w_actual, w)
 			s_actual = append(s_actual, s)
 		})
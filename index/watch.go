@@ -0,0 +1,422 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long changes are collected before they are indexed
+var WATCH_DELAY = time.Second
+
+// the changes are indexed into an in-memory segment, which is written
+// to disk after WATCH_PERSIST or when it has WATCH_PERSIST_DOCS documents
+var WATCH_PERSIST = time.Minute
+var WATCH_PERSIST_DOCS = 1000
+
+type watcher struct {
+	index      *Index
+	lock       *sync.RWMutex
+	indexer    *Indexer
+	args       []string
+	fs         *fsnotify.Watcher
+	known      map[string]location
+	dirs       map[string]bool
+	unsaved    map[*Segment]bool
+	generation int
+	pending    map[string]bool
+	memory     *Segment
+	view       *Segment
+	persisted  time.Time
+}
+
+// keeps index up to date with the files under args without restarting
+// the server: the files changed in the last WATCH_DELAY are indexed into
+// an in-memory segment, a snapshot of which replaces the previous one in
+// the live index, and their old versions are marked as deleted. lock is
+// the lock searches hold while using the index, indexer says which files
+// are indexed and how. if mergeEvery is not 0 the small segments are
+// merged every mergeEvery and the index is reloaded. runs until ctx is
+// done, then writes the in-memory segment to disk and returns ctx.Err()
+func Watch(ctx context.Context, index *Index, lock *sync.RWMutex, indexer *Indexer, args []string, mergeEvery time.Duration) error {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	lock.RLock()
+	known, _ := knownDocuments(index.segments)
+	w := &watcher{
+		index:      index,
+		lock:       lock,
+		indexer:    indexer,
+		args:       args,
+		fs:         fs,
+		known:      known,
+		dirs:       map[string]bool{},
+		unsaved:    map[*Segment]bool{},
+		generation: index.generation,
+		pending:    map[string]bool{},
+		memory:     indexer.newMemorySegment(),
+		persisted:  time.Now(),
+	}
+	lock.RUnlock()
+
+	for _, arg := range args {
+		if err := w.watchTree(arg, false); err != nil {
+			return err
+		}
+	}
+
+	flush := time.NewTicker(WATCH_DELAY)
+	defer flush.Stop()
+	var merge <-chan time.Time
+	if mergeEvery > 0 {
+		ticker := time.NewTicker(mergeEvery)
+		defer ticker.Stop()
+		merge = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			w.lock.Lock()
+			w.saveDeleted()
+			w.persist()
+			w.lock.Unlock()
+			return ctx.Err()
+		case e, ok := <-fs.Events:
+			if !ok {
+				return nil
+			}
+			if e.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+				w.pending[e.Name] = true
+			}
+		case err, ok := <-fs.Errors:
+			if !ok {
+				return nil
+			}
+			log.Print(err)
+		case <-flush.C:
+			if len(w.pending) > 0 {
+				w.flush()
+			} else if time.Since(w.persisted) >= WATCH_PERSIST || len(w.unsaved) > 0 {
+				w.lock.Lock()
+				w.saveDeleted()
+				if time.Since(w.persisted) >= WATCH_PERSIST {
+					w.persist()
+				}
+				w.lock.Unlock()
+			}
+		case <-merge:
+			w.merge()
+		}
+	}
+}
+
+// watches dir and all directories under it, if pending is true the
+// files in them are indexed with the next flush (they could have been
+// created before the directory was watched)
+func (w *watcher) watchTree(dir string, pending bool) error {
+	return filepath.Walk(dir, func(p string, f os.FileInfo, err error) error {
+		if err != nil || f == nil {
+			return nil
+		}
+		if f.IsDir() {
+			if p != dir && strings.HasPrefix(f.Name(), ".") {
+				return filepath.SkipDir
+			}
+			if err := w.fs.Add(p); err != nil {
+				return err
+			}
+			w.dirs[p] = true
+			return nil
+		}
+		if pending {
+			w.pending[p] = true
+		}
+		return nil
+	})
+}
+
+// the argument p is under, used for the repo field
+func (w *watcher) root(p string) string {
+	for _, arg := range w.args {
+		if isUnder(p, arg) {
+			return arg
+		}
+	}
+	return ""
+}
+
+// the segments were replaced since the last flush, by a merge or SIGHUP.
+// the reopened segments did not read the deletes that are not saved yet
+func (w *watcher) refresh() {
+	if w.generation != w.index.generation {
+		unsaved := map[*Segment]bool{}
+		for old := range w.unsaved {
+			found := false
+			for _, s := range w.index.segments {
+				if s.root == old.root {
+					s.addDeleted(old.deleted)
+					unsaved[s] = true
+					found = true
+				}
+			}
+			if !found {
+				log.Printf("watch: %s was merged away by another writer, its deletes are lost", old.root)
+			}
+		}
+		w.unsaved = unsaved
+		w.known, _ = knownDocuments(w.index.segments)
+		w.move(w.view, w.memory)
+		w.generation = w.index.generation
+	}
+}
+
+func (w *watcher) flush() {
+	// directories created since the last flush add their files to the
+	// next one
+	pending := w.pending
+	w.pending = map[string]bool{}
+
+	w.lock.RLock()
+	w.refresh()
+	w.lock.RUnlock()
+
+	todo := []indexable{}
+	gone := []string{}
+	for p := range pending {
+		f, err := os.Stat(p)
+		if err != nil {
+			gone = append(gone, p)
+			continue
+		}
+		if f.IsDir() {
+			if err := w.watchTree(p, true); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+		if !w.indexer.isIndexable(f) {
+			continue
+		}
+		if old, ok := w.known[p]; ok && old.info == newDocInfo(f) {
+			continue
+		}
+		todo = append(todo, indexable{p, w.root(p), newDocInfo(f), nil})
+	}
+	first := int32(len(w.memory.inmemoryForward))
+	if first == 0 {
+		w.persisted = time.Now()
+	}
+	w.add(todo)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.refresh()
+
+	changed := map[*Segment]bool{}
+	remove := func(p string) {
+		if old, ok := w.known[p]; ok {
+			old.segment.delete(old.id)
+			changed[old.segment] = true
+			delete(w.known, p)
+		}
+	}
+	for _, p := range gone {
+		remove(p)
+		if !w.dirs[p] {
+			continue
+		}
+		// a removed or renamed directory, the only gone path that needs
+		// a scan of the known documents
+		prefix := strings.TrimSuffix(p, "/") + "/"
+		for d := range w.dirs {
+			if d == p || strings.HasPrefix(d, prefix) {
+				delete(w.dirs, d)
+			}
+		}
+		for k := range w.known {
+			if strings.HasPrefix(k, prefix) {
+				remove(k)
+			}
+		}
+	}
+	for _, t := range todo {
+		remove(t.path)
+	}
+	for s := range changed {
+		if !s.inMemory() {
+			w.unsaved[s] = true
+		}
+	}
+	w.saveDeleted()
+	for id, p := range w.memory.inmemoryForward[first:] {
+		w.known[p] = location{w.memory, first + int32(id), w.memory.inmemoryInfo[first+int32(id)]}
+	}
+	if len(w.memory.inmemoryForward) > 0 {
+		w.replace(w.memory.Snapshot())
+	}
+	log.Printf("watch: indexed %d, removed %d", len(todo), len(gone))
+
+	if len(w.memory.inmemoryForward) >= WATCH_PERSIST_DOCS || time.Since(w.persisted) >= WATCH_PERSIST {
+		w.persist()
+	}
+}
+
+// replaces the view of the in-memory segment searched in the index
+func (w *watcher) replace(view *Segment) {
+	segments := []*Segment{}
+	for _, s := range w.index.segments {
+		if s != w.view {
+			segments = append(segments, s)
+		}
+	}
+	if view != nil {
+		segments = append(segments, view)
+	}
+	w.index.segments = segments
+	w.view = view
+}
+
+// the known documents in from are now in to, with the same ids
+func (w *watcher) move(from *Segment, to *Segment) {
+	for p, l := range w.known {
+		if l.segment == from {
+			w.known[p] = location{to, l.id, l.info}
+		}
+	}
+}
+
+// saves the deletes of the segments on disk while holding the writer
+// lock, with those another writer saved since they were opened. does
+// not wait for another writer, a later flush saves them then. returns
+// true if all are saved, called with the lock held
+func (w *watcher) saveDeleted() bool {
+	if len(w.unsaved) == 0 {
+		return true
+	}
+	unlock, err := lockWriter(w.index.name, false)
+	if err != nil {
+		log.Printf("watch: cannot save the deletes yet: %s", err)
+		return false
+	}
+	defer unlock()
+	for s := range w.unsaved {
+		if _, err := os.Stat(s.root); os.IsNotExist(err) {
+			log.Printf("watch: %s was merged away by another writer, its deletes are lost", s.root)
+			delete(w.unsaved, s)
+			continue
+		}
+		if err := s.reloadDeleted(); err != nil {
+			log.Printf("watch: %s", err)
+			continue
+		}
+		if err := s.saveDeleted(); err != nil {
+			log.Printf("watch: %s", err)
+			continue
+		}
+		delete(w.unsaved, s)
+	}
+	return len(w.unsaved) == 0
+}
+
+// writes the in-memory segment to disk and searches the written one
+// instead, called with the lock held. if that fails the in-memory
+// segment is kept and persisted again later
+func (w *watcher) persist() {
+	w.persisted = time.Now()
+	if len(w.memory.inmemoryForward) == 0 {
+		return
+	}
+	s, err := w.write()
+	if err != nil {
+		log.Printf("watch: cannot persist: %s", err)
+		return
+	}
+	root := s.root
+	log.Printf("watch: persisted %d documents into %s", s.forward.count(), root)
+
+	w.replace(nil)
+	w.index.segments = append(w.index.segments, s)
+	w.move(w.memory, s)
+	w.memory = w.indexer.newMemorySegment()
+}
+
+// writes the in-memory segment into a committed segment and opens it.
+// fails instead of waiting while another writer holds the index, the
+// searches wait for the persist
+func (w *watcher) write() (*Segment, error) {
+	unlock, err := lockWriter(w.index.name, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	d, err := w.indexer.createSegment()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.memory.persist(d); err != nil {
+		os.RemoveAll(d.root)
+		return nil, err
+	}
+	roots, err := commit(w.index.name, []*Segment{d}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewSegment(roots[0])
+}
+
+// adds todo to the in-memory segment
+func (w *watcher) add(todo []indexable) {
+	maxproc := w.indexer.options.Workers
+	done := make(chan int)
+	input := make(chan indexable)
+	finished := make(chan int)
+	for i := 0; i < maxproc; i++ {
+		go func() {
+			w.indexer.tokenizeAndAdd(input, done)
+			finished <- 1
+		}()
+	}
+	for _, t := range todo {
+		t.segment = w.memory
+		input <- t
+	}
+	for i := 0; i < maxproc; i++ {
+		done <- 1
+		<-finished
+	}
+}
+
+// the merge copies the deletes from disk, so they are saved first
+func (w *watcher) merge() {
+	w.lock.Lock()
+	saved := w.saveDeleted()
+	w.lock.Unlock()
+	if !saved {
+		log.Printf("watch: not merging, the deletes are not saved")
+		return
+	}
+	var err error
+	Took(fmt.Sprintf("merging %s", w.index.name), func() {
+		err = Merge(w.index.name)
+	})
+	if err != nil {
+		log.Printf("watch: cannot merge: %s", err)
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.index.Reload(); err != nil {
+		log.Printf("watch: cannot reload: %s", err)
+	}
+}
@@ -0,0 +1,145 @@
+package index
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	defer func(delay time.Duration) { WATCH_DELAY = delay }(WATCH_DELAY)
+	WATCH_DELAY = 10 * time.Millisecond
+
+	src := t.TempDir()
+	write := func(name string, data string) {
+		if err := os.MkdirAll(path.Dir(path.Join(src, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := t.TempDir()
+	indexer := NewIndexer(name, IndexerOptions{Extensions: []string{".go"}, Workers: 1})
+	write("a.go", "func Alpha()")
+	write("pkg/b.go", "func Beta()")
+	write("pkg/sub/c.go", "func Gamma()")
+	write("e.go", "func Epsilon()")
+	write("z.go", "func Zeta()")
+	if err := indexer.Index([]string{src}); err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := NewSearcher(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- searcher.Watch(ctx, indexer, []string{src}, 0)
+	}()
+	defer func() {
+		cancel()
+		if err := <-stopped; err != context.Canceled {
+			t.Errorf("expected context.Canceled, actual %v", err)
+		}
+	}()
+
+	paths := func(query string) []string {
+		res, err := searcher.Search(context.Background(), query, SearchOptions{ExactCount: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := []string{}
+		for _, hit := range res.Hits {
+			found = append(found, hit.Path)
+		}
+		return found
+	}
+	// the changes are indexed with the next flush
+	wait := func(query string, expected ...string) {
+		var found []string
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(WATCH_DELAY) {
+			found = paths(query)
+			if len(found) == len(expected) {
+				ok := true
+				for i := range found {
+					ok = ok && found[i] == path.Join(src, expected[i])
+				}
+				if ok {
+					return
+				}
+			}
+		}
+		t.Fatalf("%s: expected %v, actual %v", query, expected, found)
+	}
+
+	// the directories are watched once Watch has started
+	for start := time.Now(); len(paths("Ready")) == 0; time.Sleep(WATCH_DELAY) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the watcher did not start")
+		}
+		write("ready.go", "func Ready()")
+	}
+
+	write("d.go", "func Delta()")
+	wait("Delta", "d.go")
+
+	write("a.go", "func Alpha(modified bool)")
+	wait("modified", "a.go")
+	wait("Alpha", "a.go")
+
+	if err := os.Remove(path.Join(src, "d.go")); err != nil {
+		t.Fatal(err)
+	}
+	wait("Delta")
+
+	if err := os.Rename(path.Join(src, "pkg"), path.Join(src, "lib")); err != nil {
+		t.Fatal(err)
+	}
+	wait("Beta", "lib/b.go")
+	wait("Gamma", "lib/sub/c.go")
+
+	// the renamed directories are watched under their new name
+	write("lib/sub/c.go", "func Gamma(renamed bool)")
+	wait("renamed", "lib/sub/c.go")
+	wait("Gamma", "lib/sub/c.go")
+
+	// the deletes are saved once no other writer holds the index, with
+	// the deletes of that writer
+	unlock, err := lockWriter(name, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path.Join(src, "e.go")); err != nil {
+		t.Fatal(err)
+	}
+	wait("Epsilon")
+	index, err := NewIndex(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, _ := knownDocuments(index.segments)
+	other := known[path.Join(src, "z.go")]
+	other.segment.delete(other.id)
+	if err := other.segment.saveDeleted(); err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+	if n := count(t, name, "Epsilon"); n != 1 {
+		t.Fatalf("expected the delete to wait for the writer lock, actual %d files", n)
+	}
+	unlock()
+	for start := time.Now(); count(t, name, "Epsilon") != 0; time.Sleep(WATCH_DELAY) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("the delete was not saved")
+		}
+	}
+	if n := count(t, name, "Zeta"); n != 0 {
+		t.Fatalf("expected the delete of the other writer to stay, actual %d files", n)
+	}
+}
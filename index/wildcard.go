@@ -0,0 +1,195 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// the most terms a wildcard or fuzzy query expands to in a segment, the
+// closest terms in the most documents are kept
+var MAX_EXPANSIONS = 256
+
+// the terms a WildcardQuery or FuzzyQuery expands to in the prepared
+// segment, searched as a BoolOrQuery
+type expandedQuery struct {
+	or *BoolOrQuery
+}
+
+func (q *expandedQuery) prepare(s *Segment, terms []*Term) {
+	queries := make([]Query, len(terms))
+	for i, t := range terms {
+		queries[i] = t
+	}
+	q.or = NewBoolOrQuery(queries)
+	q.or.Prepare(s)
+}
+
+func (q *expandedQuery) AddSubQuery(sub Query) {
+	// noop
+}
+
+func (q *expandedQuery) GetDocId() int32 {
+	return q.or.GetDocId()
+}
+
+func (q *expandedQuery) Cost() uint32 {
+	return q.or.Cost()
+}
+
+func (q *expandedQuery) Score() float64 {
+	return q.or.Score()
+}
+
+func (q *expandedQuery) maxScore() float64 {
+	return q.or.maxScore()
+}
+
+func (q *expandedQuery) blockMaxScore(target int32) (float64, int32) {
+	return q.or.blockMaxScore(target)
+}
+
+func (q *expandedQuery) setMinScore(min float64) bool {
+	return q.or.setMinScore(min)
+}
+
+func (q *expandedQuery) advance(target int32) int32 {
+	return q.or.advance(target)
+}
+
+func (q *expandedQuery) Next() int32 {
+	return q.or.Next()
+}
+
+// a term of the dictionary, with its edit distance for a FuzzyQuery
+type expansion struct {
+	text     string
+	docs     uint64
+	distance int
+}
+
+func (s *Segment) expansion(text string, extra uint64, distance int) expansion {
+	docs, _ := binary.Uvarint(postingsAt(s.postings, extra))
+	return expansion{text, docs, distance}
+}
+
+// at most MAX_EXPANSIONS, the closest and then those in the most documents
+func limitExpansions(expansions []expansion) []expansion {
+	if len(expansions) > MAX_EXPANSIONS {
+		sort.SliceStable(expansions, func(i, j int) bool {
+			a, b := expansions[i], expansions[j]
+			if a.distance != b.distance {
+				return a.distance < b.distance
+			}
+			return a.docs > b.docs
+		})
+		expansions = expansions[:MAX_EXPANSIONS]
+	}
+	return expansions
+}
+
+// matches the documents of the terms of a field that match a pattern,
+// where * is any number of characters, e.g. Atomic* or Load*Int. the
+// terms are found in each segment by scanning the sorted dictionary from
+// the part of the pattern before the first *, and searched as a
+// BoolOrQuery
+type WildcardQuery struct {
+	field   string
+	pattern string
+	prefix  string
+	scoring int
+	expandedQuery
+}
+
+func NewWildcardQuery(field string, pattern string) *WildcardQuery {
+	prefix := pattern
+	if i := strings.IndexByte(pattern, '*'); i != -1 {
+		prefix = pattern[:i]
+	}
+	return &WildcardQuery{
+		field:         field,
+		pattern:       pattern,
+		prefix:        prefix,
+		scoring:       DEFAULT_SCORING,
+		expandedQuery: expandedQuery{NewBoolOrQuery([]Query{})},
+	}
+}
+
+func (q *WildcardQuery) String() string {
+	if q.field == FIELD_CONTENT {
+		return q.pattern
+	}
+	return q.field + ":" + q.pattern
+}
+
+func (q *WildcardQuery) match(text string) bool {
+	// the pattern only has token characters and *, which path.Match
+	// treats the same
+	ok, _ := path.Match(q.pattern, text)
+	return ok
+}
+
+func (q *WildcardQuery) Clone() Query {
+	c := NewWildcardQuery(q.field, q.pattern)
+	c.scoring = q.scoring
+	return c
+}
+
+func (q *WildcardQuery) Prepare(s *Segment) {
+	terms := []*Term{}
+	for _, e := range s.expandTerms(q.field, q.prefix, q.match) {
+		t := NewFieldTerm(q.field, e.text)
+		t.scoring = q.scoring
+		terms = append(terms, t)
+	}
+	q.prepare(s, terms)
+}
+
+// the terms of field that start with prefix and match
+func (s *Segment) expandTerms(field string, prefix string, match func(string) bool) []expansion {
+	expansions := []expansion{}
+	start := []byte(fieldTerm(field, prefix))
+	for id := s.inverted.search(start); id < s.inverted.count(); {
+		term := s.inverted.bytes(id)
+		if !bytes.HasPrefix(term, start) {
+			break
+		}
+		if next := s.skipFieldTerms(field, term); next != -1 {
+			id = next
+			continue
+		}
+		if text := string(term[len(start)-len(prefix):]); match(text) {
+			expansions = append(expansions, s.expansion(text, s.inverted.extra(uint32(id)), 0))
+		}
+		id++
+	}
+	return limitExpansions(expansions)
+}
+
+// content terms have no field prefix, so the range of a content prefix
+// also has the terms of the fields whose names start with it, e.g. pa*
+// has all the path terms. when scanning the content terms and term is a
+// term of another field, returns the id of the first term after that
+// field, -1 otherwise
+func (s *Segment) skipFieldTerms(field string, term []byte) int {
+	if field != FIELD_CONTENT {
+		return -1
+	}
+	i := bytes.IndexByte(term, FIELD_SEPARATOR[0])
+	if i == -1 {
+		return -1
+	}
+	return s.inverted.search(prefixEnd(term[:i+1]))
+}
+
+// a wildcard has to start with a token character, so that the dictionary
+// is not scanned from the start
+func checkWildcard(word string, pos int) error {
+	if word[0] == '*' {
+		return fmt.Errorf("wildcard %s at position %d has to start with a letter, digit, _ or :", word, pos)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package index
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWildcardQuery(t *testing.T) {
+	s := NewMemorySegment()
+	addDocuments(s, map[string]string{
+		"/src/net/udp.go": "func ListenUDP(network string) (*UDPConn, error)",
+		"/src/net/tcp.go": "func ListenTCP(network string) (*TCPListener, error)",
+		"/src/os/file.go": "func Open(name string) (*File, error)",
+	})
+	snapshot := s.Snapshot()
+
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"Listen*", []string{"/src/net/tcp.go", "/src/net/udp.go"}},
+		{"Listen*DP", []string{"/src/net/udp.go"}},
+		{"TCP*", []string{"/src/net/tcp.go"}},
+		{"Listen* -TCP*", []string{"/src/net/udp.go"}},
+		{"file:fi*", []string{"/src/os/file.go"}},
+		{"src*", []string{"/src/net/tcp.go", "/src/net/udp.go", "/src/os/file.go"}},
+		// the content range of fi has all the file terms, they are skipped
+		{"content:fi*", []string{}},
+		{"content:src*", []string{}},
+		{"Nope*", []string{}},
+	}
+	for _, test := range tests {
+		actual := search(t, snapshot, test.query)
+		if fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+			t.Fatalf("%s: expected %v, actual %v", test.query, test.expected, actual)
+		}
+	}
+
+	// a content scan jumps over the terms of the other fields at once
+	files := fieldTerm(FIELD_BASENAME, "")
+	isFile := func(id int) bool {
+		return strings.HasPrefix(string(snapshot.inverted.bytes(id)), files)
+	}
+	first := snapshot.inverted.search([]byte(files))
+	next := snapshot.skipFieldTerms(FIELD_CONTENT, snapshot.inverted.bytes(first))
+	if !isFile(first) || next <= first || !isFile(next-1) || isFile(next) {
+		t.Fatalf("expected to skip the file terms from %d, actual %d", first, next)
+	}
+	if next := snapshot.skipFieldTerms(FIELD_BASENAME, snapshot.inverted.bytes(first)); next != -1 {
+		t.Fatalf("expected no skip for the file field, actual %d", next)
+	}
+
+	defer func(max int) { MAX_EXPANSIONS = max }(MAX_EXPANSIONS)
+	MAX_EXPANSIONS = 1
+	if actual := snapshot.expandTerms(FIELD_CONTENT, "Listen", NewWildcardQuery(FIELD_CONTENT, "Listen*").match); len(actual) != 1 || actual[0].text != "ListenTCP" {
+		t.Fatalf("expected one expansion, actual %v", actual)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	idx "./index"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -15,57 +16,176 @@ import (
 	"path"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
-type Hit struct {
-	Path    string
-	Id      int32
-	Segment int
-	Score   int64
+type Result struct {
+	Hits                     []*idx.Hit
+	Next                     string `json:",omitempty"`
+	FilesMatching            int
+	FilesMatchingApproximate bool
+	FilesInIndex             int
+	TokensInIndex            int
+	TookSeconds              float64
+	Partial                  bool
 }
 
-type Result struct {
-	Hits          []*Hit
-	FilesMatching int
-	FilesInIndex  int
-	TokensInIndex int
-	TookSeconds   float64
+// zearch dump terms | postings TERM | forward
+func dump(name string, segment string, asJson bool, args []string) {
+	index, err := idx.NewIndex(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer index.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	print := func(v interface{}, text string) {
+		if asJson {
+			encoder.Encode(v)
+		} else {
+			fmt.Println(text)
+		}
+	}
+	what := ""
+	if len(args) > 0 {
+		what = args[0]
+	}
+	switch {
+	case what == "terms":
+		index.DumpTerms(segment, func(t idx.TermInfo) {
+			print(t, fmt.Sprintf("%s\t%s\t%d", t.Segment, t, t.DocFreq))
+		})
+	case what == "postings" && len(args) == 2:
+		index.DumpPostings(segment, args[1], func(p idx.PostingInfo) {
+			print(p, fmt.Sprintf("%s\t%d\t%s\t%d\t%v\t%v", p.Segment, p.Id, p.Path, p.Count, p.Positions, p.Deleted))
+		})
+	case what == "forward":
+		index.DumpForward(segment, func(d idx.DocumentInfo) {
+			print(d, fmt.Sprintf("%s\t%d\t%s\t%d\t%d\t%d\t%v", d.Segment, d.Id, d.Path, d.Length, d.Mtime, d.Size, d.Deleted))
+		})
+	default:
+		log.Fatalf("usage: zearch -dir-to-store DIR [-segment segment.N] [-json] dump terms | postings TERM | forward")
+	}
 }
 
 func main() {
 	pdirtoindex := flag.String("dir-to-index", "", "directory to index")
+	pincremental := flag.Bool("incremental", false, "only index new and modified files, and remove deleted ones from an existing index")
 	pstoredir := flag.String("dir-to-store", path.Join("tmp", "zearch"), "directory to store the index")
 	paddr := flag.String("bind", ":8080", "address to bind to")
+	ppositions := flag.Bool("store-positions", true, "store token positions when indexing, needed for exact \"phrase queries\"")
+	ptrigrams := flag.Bool("store-trigrams", true, "store a trigram index when indexing, used to speed up /regexp/ queries")
+	pscoring := flag.String("scoring", "bm25", "default scoring: bm25 or count")
+	psegment := flag.String("segment", "", "dump: only this segment, e.g. segment.0")
+	pjson := flag.Bool("json", false, "dump: print one json object per line")
+	pquarantine := flag.Bool("quarantine", false, "check: move broken segments out of the index")
+	pwatch := flag.Bool("watch", false, "bring the index up to date with -dir-to-index, then serve it and index changes as they happen")
+	pparallelism := flag.Int("search-parallelism", idx.SEARCH_PARALLELISM, "how many segments are searched at the same time")
+	ptimeout := flag.Duration("search-timeout", 10*time.Second, "stop searching after this long and return the hits found so far, 0 disables, &timeout=1s in the url overrides it")
+	pmergeevery := flag.Duration("merge-every", 0, "merge small segments in the background every interval (e.g. 1h) and reload, 0 disables")
 	flag.Parse()
 
-	rwlock := &sync.RWMutex{}
-	if len(*pdirtoindex) > 0 {
+	scoring, err := idx.ParseScoring(*pscoring)
+	if err != nil {
+		log.Fatal(err)
+	}
+	idx.DEFAULT_SCORING = scoring
+
+	options := idx.DefaultIndexerOptions()
+	options.NoPositions = !*ppositions
+	options.NoTrigrams = !*ptrigrams
+	indexer := idx.NewIndexer(*pstoredir, options)
+
+	if len(*pdirtoindex) > 0 && !*pwatch {
 		a := strings.Split(*pdirtoindex, ",")
 		idx.Took(fmt.Sprintf("indexing %#v", a), func() {
-			idx.DoIndex(*pstoredir, a)
+			if *pincremental {
+				err = indexer.Update(a)
+			} else {
+				err = indexer.Index(a)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "check" {
+		broken, err := idx.Check(*pstoredir, *pquarantine, func(root string, problems []string) {
+			if len(problems) == 0 {
+				fmt.Printf("%s: ok\n", root)
+			}
+			for _, p := range problems {
+				fmt.Printf("%s: %s\n", root, p)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if broken > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "dump" {
+		dump(*pstoredir, *psegment, *pjson, flag.Args()[1:])
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "merge" {
+		idx.Took(fmt.Sprintf("merging %s", *pstoredir), func() {
+			err = idx.Merge(*pstoredir)
 		})
+		if err != nil {
+			log.Fatal(err)
+		}
 		os.Exit(0)
 	}
-	index := idx.NewIndex(*pstoredir)
+	if *pwatch {
+		a := strings.Split(*pdirtoindex, ",")
+		idx.Took(fmt.Sprintf("incremental indexing %#v", a), func() {
+			err = indexer.Update(a)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	searcher, err := indexer.NewSearcher()
+	if err != nil {
+		log.Fatal(err)
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func() {
 		for range c {
-			rwlock.Lock()
-
-			index.Close()
-			index = idx.NewIndex(*pstoredir)
-
-			rwlock.Unlock()
+			if err := searcher.Reload(); err != nil {
+				log.Printf("reload failed, still serving the old index: %s", err)
+			}
 		}
 	}()
+	if *pwatch {
+		go func() {
+			if err := searcher.Watch(context.Background(), indexer, strings.Split(*pdirtoindex, ","), *pmergeevery); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	} else if *pmergeevery > 0 {
+		go func() {
+			for range time.Tick(*pmergeevery) {
+				var err error
+				idx.Took(fmt.Sprintf("merging %s", *pstoredir), func() {
+					err = idx.Merge(*pstoredir)
+				})
+				if err != nil {
+					log.Printf("merge failed: %s", err)
+					continue
+				}
+				c <- syscall.SIGHUP
+			}
+		}()
+	}
 
 	http.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
-		rwlock.RLock()
-		defer rwlock.RUnlock()
 		splitted := strings.Split(r.URL.RawQuery, ",")
 		if len(splitted) != 2 {
 			w.WriteHeader(http.StatusNotFound)
@@ -75,7 +195,7 @@ func main() {
 			if errId != nil || errSegment != nil {
 				w.WriteHeader(http.StatusBadRequest)
 			} else {
-				path, ok := index.FetchForward(id, int(segment))
+				path, ok := searcher.Fetch(int32(id), segment)
 				if !ok {
 					w.WriteHeader(http.StatusNotFound)
 				} else {
@@ -91,62 +211,64 @@ func main() {
 	})
 
 	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		t0 := time.Now()
-
-		rwlock.RLock()
-		defer rwlock.RUnlock()
-
-		queries := []idx.Query{}
-		unescaped, _ := url.QueryUnescape(r.URL.RawQuery)
-		idx.Tokenize(unescaped, func(text string, weird int) {
-			queries = append(queries, idx.NewTerm(text))
-		})
-		var query idx.Query
-		if len(queries) == 1 {
-			query = queries[0]
-		} else {
-			query = idx.NewBoolAndQuery(queries)
+		// either /search?q=udp+ipv4&context=2 or just /search?udp%20ipv4
+		params := r.URL.Query()
+		text, ok := params["q"]
+		if !ok {
+			unescaped, _ := url.QueryUnescape(r.URL.RawQuery)
+			text = []string{unescaped}
 		}
-
-		hits := []*Hit{}
-		maxSize := 100
-		add := func(h *Hit) {
-			do_insert := false
-			if len(hits) < maxSize {
-				hits = append(hits, h)
-				do_insert = true
-			} else if hits[len(hits)-1].Score < h.Score {
-				do_insert = true
-			}
-			if do_insert {
-				for i := 0; i < len(hits); i++ {
-					if hits[i].Score < h.Score {
-						copy(hits[i+1:], hits[i:])
-						hits[i] = h
-						break
-					}
-				}
+		context, _ := strconv.Atoi(params.Get("context"))
+		if context > idx.MAX_CONTEXT {
+			context = idx.MAX_CONTEXT
+		}
+		limit, _ := strconv.Atoi(params.Get("limit"))
+		offset, _ := strconv.Atoi(params.Get("offset"))
+		timeout := *ptimeout
+		if params.Get("timeout") != "" {
+			var err error
+			if timeout, err = time.ParseDuration(params.Get("timeout")); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
 			}
 		}
-
-		total := 0
-		index.ExecuteQuery(query, func(id int32, segment int, score int64) {
-			total++
-			add(&Hit{Id: id, Segment: segment, Score: score})
+		// &count=exact counts every matching file instead of skipping
+		// those that cannot make it into the hits
+		count := params.Get("count")
+		if count != "" && count != "exact" && count != "approximate" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("unknown count " + strconv.Quote(count) + ", use exact or approximate"))
+			return
+		}
+		// stops when the client goes away
+		found, err := searcher.Search(r.Context(), text[0], idx.SearchOptions{
+			Limit:       limit,
+			Offset:      offset,
+			After:       params.Get("after"),
+			Sort:        params.Get("sort"),
+			Scoring:     params.Get("scoring"),
+			Highlight:   true,
+			Context:     context,
+			Timeout:     timeout,
+			Parallelism: *pparallelism,
+			ExactCount:  count == "exact",
 		})
-
-		for _, hit := range hits {
-			hit.Path, _ = index.FetchForward(int(hit.Id), hit.Segment)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
 		}
 
-		elapsed := time.Since(t0)
-		totalfiles, approxterms := index.Stats()
 		res := &Result{
-			Hits:          hits,
-			FilesMatching: total,
-			FilesInIndex:  totalfiles,
-			TokensInIndex: approxterms,
-			TookSeconds:   elapsed.Seconds(),
+			Hits:                     found.Hits,
+			Next:                     found.Next,
+			FilesMatching:            found.FilesMatching,
+			FilesMatchingApproximate: found.FilesMatchingApproximate,
+			FilesInIndex:             found.FilesInIndex,
+			TokensInIndex:            found.TokensInIndex,
+			TookSeconds:              found.Took.Seconds(),
+			Partial:                  found.Partial,
 		}
 
 		b, err := json.Marshal(res)
@@ -169,6 +291,14 @@ body {
     padding: 10px;
 }
 
+.context {
+    color: #999;
+}
+
+b {
+    background-color: #ff9;
+}
+
 input {
     width: 200px;
     height: 30px;
@@ -182,21 +312,55 @@ input {
 </body>
 <script>
 var res = document.getElementById("res")
+var escape = function(text) {
+    return text.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+}
+var highlight = function(line) {
+    var chars = Array.from(line.Text)
+    var s = ""
+    var last = 0
+    for (var i = 0; i < line.Matches.length; i++) {
+        var m = line.Matches[i]
+        s += escape(chars.slice(last, m.Start).join("")) + "<b>" + escape(chars.slice(m.Start, m.End).join("")) + "</b>"
+        last = m.End
+    }
+    return s + escape(chars.slice(last).join(""))
+}
+var render = function(line) {
+    var s = ""
+    var before = line.Before || []
+    var after = line.After || []
+    for (var i = 0; i < before.length; i++) {
+        s += "<span class=context>" + pad(line.Number - before.length + i) + "  " + escape(before[i]) + "</span>\n"
+    }
+    s += pad(line.Number) + ": " + highlight(line) + "\n"
+    for (var i = 0; i < after.length; i++) {
+        s += "<span class=context>" + pad(line.Number + 1 + i) + "  " + escape(after[i]) + "</span>\n"
+    }
+    return s
+}
+var pad = function(n) {
+    return ("      " + n).slice(-7)
+}
 var work = function(query) {
     var s = ""
     res.innerHTML = s
 
     var xhr = new XMLHttpRequest();
-    xhr.open('GET', '/search?' + query);
+    xhr.open('GET', '/search?context=1&q=' + encodeURIComponent(query));
     xhr.send(null);
     xhr.onreadystatechange = function () {
        if (xhr.readyState === 4) {
            if (xhr.status === 200) {
                data = JSON.parse(xhr.responseText);
-               s += "took: " + data.TookSeconds.toFixed(5) + "s, matching: " + data.FilesMatching + ", searched in " + data.FilesInIndex + " files and " + data.TokensInIndex + " tokens\n"
+               s += "took: " + data.TookSeconds.toFixed(5) + "s, matching: " + (data.FilesMatchingApproximate ? "at least " : "") + data.FilesMatching + ", searched in " + data.FilesInIndex + " files and " + data.TokensInIndex + " tokens" + (data.Partial ? ", timed out, partial results" : "") + "\n"
                for (var i = 0; i < data.Hits.length; i++) {
                    var hit = data.Hits[i]
-                   s +=  hit.Score + " <a href='/fetch?"+hit.Id +"," + hit.Segment + "#" + hit.Path+"'>"+hit.Path+"</a>\n"
+                   s +=  hit.Score.toFixed(2) + " <a href='/fetch?"+hit.Id +"," + hit.Segment + "#" + hit.Path+"'>"+hit.Path+"</a>\n"
+                   var lines = hit.Lines || []
+                   for (var j = 0; j < lines.length; j++) {
+                       s += render(lines[j])
+                   }
                }
                res.innerHTML = s
                window.location.hash = query
@@ -19,28 +19,68 @@
     (delete-region (point) (point-min))
     (buffer-string)))
 
-(defun zearch-fetch (id)
+(defun zearch-fetch (id &optional line)
   (kill-buffer (get-buffer-create "*zearch-fetch*"))
   (with-current-buffer (get-buffer-create "*zearch-fetch*")
     (insert (zearch-http-get (format "https://zearch.io/fetch?%s" id)))
-    (goto-char (point-min)))
+    (goto-char (point-min))
+    (when line
+      (forward-line (1- line))))
   (switch-to-buffer "*zearch-fetch*"))
 
+;; lines of context shown before and after each matching line
+(defvar zearch-context 1)
+
+;; a line of context around a matching line, like grep -C prints it
+(defun zearch-insert-context (id number text)
+  (let ((start (point)))
+    (insert (format "    %6d- " number) text)
+    (put-text-property start (point) 'face 'shadow)
+    (put-text-property start (point) 'zearch-id id)
+    (put-text-property start (point) 'zearch-line number)
+    (newline)))
+
+;; matching line of a hit, with the matches highlighted and its context, RET on it opens the file at that line
+(defun zearch-insert-line (id line)
+  (let ((number (assoc-default 'Number line))
+        (text (assoc-default 'Text line))
+        (matches (assoc-default 'Matches line))
+        (before (assoc-default 'Before line))
+        (after (assoc-default 'After line)))
+    (dotimes (j (length before))
+      (zearch-insert-context id (+ (- number (length before)) j) (elt before j)))
+    (let ((prefix (format "    %6d: " number))
+          (start (point)))
+      (insert prefix text)
+      (dotimes (j (length matches))
+        (let ((m (elt matches j)))
+          (put-text-property (+ start (length prefix) (assoc-default 'Start m))
+                             (+ start (length prefix) (assoc-default 'End m))
+                             'face 'highlight)))
+      (put-text-property start (point) 'zearch-id id)
+      (put-text-property start (point) 'zearch-line number)
+      (newline))
+    (dotimes (j (length after))
+      (zearch-insert-context id (+ number 1 j) (elt after j)))))
+
 (defun zearch-search (query)
   (kill-buffer (get-buffer-create "*zearch*"))
   (with-current-buffer (get-buffer-create "*zearch*")
     (insert (format "results for: %s" query))
     (newline)
-    (let ((xurl (format "https://zearch.io/search?%s" query)))
+    (let ((xurl (format "https://zearch.io/search?context=%d&q=%s" zearch-context (url-hexify-string query))))
       (let ((hits (assoc-default 'Hits (zearch-json-get xurl))))
         (dotimes (i (length hits))
           (let ((hit (elt hits i)))
             (let ((path (assoc-default 'Path hit))
                   (id (assoc-default 'Id hit))
                   (segment (assoc-default 'Segment hit))
-                  (score (assoc-default 'Score hit)))
-              (insert (format "%s | s:%d | %07d,%05d" path score id segment))
-              (newline))))))
+                  (score (assoc-default 'Score hit))
+                  (lines (assoc-default 'Lines hit)))
+              (insert (format "%s | s:%.2f | %07d,%05d" path score id segment))
+              (newline)
+              (dotimes (j (length lines))
+                (zearch-insert-line (format "%d,%d" id segment) (elt lines j))))))))
     (zearch-mode)
     (goto-char (point-min)))
   (switch-to-buffer "*zearch*"))
@@ -59,8 +99,10 @@
   (let ((map (make-sparse-keymap))
         (fetch (lambda ()
                  (interactive)
-                 (let ((line (thing-at-point 'line t)))
-                   (zearch-fetch (substring line -14 -1)))))) ;; last 10,5 digits are the id
+                 (let ((id (get-text-property (point) 'zearch-id))
+                       (number (get-text-property (point) 'zearch-line))
+                       (line (thing-at-point 'line t)))
+                   (zearch-fetch (or id (substring line -14 -1)) number))))) ;; last 10,5 digits are the id
     (define-key map (kbd "RET") fetch) 
     (define-key map "\C-j" fetch)
     (define-key map "\C-m" fetch)
@@ -122,14 +122,33 @@ func main() {
 				r.pull()
 			}
 
+			a := strings.Split(*SRC, ",")
+			if _, err := os.Stat(*INDEX); err == nil {
+				// only reindex what changed since the last pull, the
+				// server picks up the new segments and deletions on SIGHUP
+				idx.Took(fmt.Sprintf("incremental indexing %#v", a), func() {
+					err = idx.DoIndexIncremental(*INDEX, a)
+				})
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				exec_dont_care("pkill", "--signal", "1", "zearch$")
+				old_body = body
+				continue
+			}
+
 			name := name_for_iteration(current)
 			remove(name_for_iteration(current - 2))
 			remove(name)
 
-			a := strings.Split(*SRC, ",")
 			idx.Took(fmt.Sprintf("indexing %#v", a), func() {
-				idx.DoIndex(name, a)
+				err = idx.DoIndex(name, a)
 			})
+			if err != nil {
+				log.Print(err)
+				continue
+			}
 
 			tmp := fmt.Sprintf("%s.lnk", name)
 			if err := os.Symlink(name, tmp); err != nil {